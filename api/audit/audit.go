@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"time"
+)
+
+// Actions of the role mutations that are audited
+const (
+	ActionCreate       = "create"
+	ActionAddRoles     = "addroles"
+	ActionDeleteRoles  = "deleteroles"
+	ActionReplaceRoles = "replaceroles"
+	ActionOffboard     = "offboard"
+	ActionTransfer     = "transfer"
+	ActionHandover     = "handover"
+)
+
+// Outcomes of an audited mutation
+const (
+	OutcomeSuccess    = "success"
+	OutcomeRejected   = "rejected"    // refused before anything was written
+	OutcomeRolledBack = "rolled-back" // failed halfway and was undone
+)
+
+// Event records the change a single request made to the roles of a user in one organization.
+// Org is `KLPD-SatuanKerja`, or empty for tenant roles such as Super Admin.
+// Its KLPD and Satuan Kerja are recorded apart, as the name can't be split back.
+// A request touching several organizations records one event for each of them.
+type Event struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request-id"`
+	Action      string    `json:"action"`
+	Assigner    string    `json:"assigner"`
+	Target      string    `json:"target"`
+	Org         string    `json:"org"`
+	KLPD        string    `json:"klpd,omitempty"`
+	SatuanKerja string    `json:"satuan-kerja,omitempty"`
+	RolesBefore []string  `json:"roles-before"`
+	RolesAfter  []string  `json:"roles-after"`
+	Requested   []string  `json:"requested"`         // the roles named in the request
+	Blocked     bool      `json:"blocked,omitempty"` // the request blocks the target from logging in
+	Outcome     string    `json:"outcome"`
+	Errors      []string  `json:"errors,omitempty"`
+
+	// Position in the hash chain, set by the sink, see ComputeHash
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prev-hash"`
+	Hash     string `json:"hash"`
+}
+
+// Sink stores audit events. Events are only ever appended, never changed or removed.
+type Sink interface {
+	Write(events ...Event) error
+}
+
+// Discard is a Sink dropping every event
+type Discard struct{}
+
+func (Discard) Write(events ...Event) error {
+	return nil
+}
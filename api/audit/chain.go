@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Hash of an event, covering every field but Hash itself.
+// As every event includes the hash of the previous one, changing, removing
+// or reordering any event breaks the hash of every event after it.
+func (e Event) ComputeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Checkpoint vouches for the head of the chain at some point in time.
+// Checkpoints are kept apart from the log, in `<audit log>.checkpoints`, so that
+// truncating the log, or rewriting it entirely, is detected as well.
+// Events written after the last checkpoint are not covered: dropping them is not detected.
+type Checkpoint struct {
+	Seq       uint64    `json:"seq"`
+	Hash      string    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+}
+
+func (c Checkpoint) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s:%s", c.Seq, c.Hash, c.Time.Format(time.RFC3339Nano))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether the checkpoint was signed with `key`
+func (c Checkpoint) Valid(key []byte) bool {
+	return hmac.Equal([]byte(c.sign(key)), []byte(c.Signature))
+}
+
+func checkpointPath(path string) string {
+	return path + ".checkpoints"
+}
+
+// BrokenLink is the first place where an audit log does not verify
+type BrokenLink struct {
+	Line   int // line of the audit log, or of the checkpoint file if Checkpoint is set
+	Seq    uint64
+	Reason string
+
+	Checkpoint bool
+}
+
+func (b *BrokenLink) Error() string {
+	if b.Checkpoint {
+		return fmt.Sprintf("checkpoint at line %d (seq %d): %s", b.Line, b.Seq, b.Reason)
+	}
+	return fmt.Sprintf("audit log line %d (seq %d): %s", b.Line, b.Seq, b.Reason)
+}
+
+// Result of a successful verification
+type Report struct {
+	Events      int
+	Checkpoints int
+	Head        string // hash of the last event
+}
+
+// Walk the hash chain of the audit log at `path` and check every checkpoint
+// against it with `key`. Returns a *BrokenLink for the first link that does not verify,
+// including a log with events but without checkpoints. Checkpoints are skipped if `key` is empty
+func Verify(path string, key []byte) (*Report, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading audit log %s. Err: %s", path, err)
+	}
+	defer file.Close()
+
+	report := &Report{}
+	hashes := make(map[uint64]string)
+	prevHash := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return nil, &BrokenLink{Line: line, Seq: uint64(line), Reason: "invalid event: " + err.Error()}
+		}
+
+		switch {
+		case event.Seq != uint64(line):
+			return nil, &BrokenLink{Line: line, Seq: event.Seq, Reason: fmt.Sprintf("expected seq %d", line)}
+		case event.PrevHash != prevHash:
+			return nil, &BrokenLink{Line: line, Seq: event.Seq, Reason: "prev-hash does not match the previous event"}
+		case event.Hash != event.ComputeHash():
+			return nil, &BrokenLink{Line: line, Seq: event.Seq, Reason: "hash does not match the event"}
+		}
+		prevHash = event.Hash
+		hashes[event.Seq] = event.Hash
+		report.Events++
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	report.Head = prevHash
+
+	if len(key) == 0 {
+		return report, nil
+	}
+
+	checkpoints, err := readCheckpoints(checkpointPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(checkpoints) == 0 && report.Events != 0 {
+		// a rewritten log would verify without them
+		return nil, &BrokenLink{Line: 1, Seq: uint64(report.Events), Reason: "no checkpoint of the audit log", Checkpoint: true}
+	}
+	for i, checkpoint := range checkpoints {
+		link := &BrokenLink{Line: i + 1, Seq: checkpoint.Seq, Checkpoint: true}
+		switch {
+		case !checkpoint.Valid(key):
+			link.Reason = "invalid signature"
+			return nil, link
+		case hashes[checkpoint.Seq] == "":
+			link.Reason = "event missing from the audit log"
+			return nil, link
+		case hashes[checkpoint.Seq] != checkpoint.Hash:
+			link.Reason = "hash does not match the audit log"
+			return nil, link
+		}
+		report.Checkpoints++
+	}
+	return report, nil
+}
+
+func readCheckpoints(path string) ([]Checkpoint, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading checkpoints %s. Err: %s", path, err)
+	}
+	defer file.Close()
+
+	checkpoints := make([]Checkpoint, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var checkpoint Checkpoint
+		err = json.Unmarshal(scanner.Bytes(), &checkpoint)
+		if err != nil {
+			return nil, &BrokenLink{Line: line, Reason: "invalid checkpoint: " + err.Error(), Checkpoint: true}
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, scanner.Err()
+}
@@ -0,0 +1,255 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileSink appends every event as a json line to a local file, chaining each
+// event to the previous one by its hash, see Event.ComputeHash.
+// The file is opened in append-only mode and synced after every write.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+
+	// head of the hash chain
+	seq  uint64
+	head string
+
+	// the offset of every event in the file, by seq, see Scan
+	index []offset
+	size  int64
+
+	// signed checkpoints, see EnableCheckpoints
+	key             []byte
+	checkpointEvery int
+	uncheckpointed  int
+	checkpoints     *os.File
+}
+
+type offset struct {
+	seq    uint64
+	offset int64
+}
+
+// Open (or create) the audit log at `path` and continue its hash chain
+func NewFileSink(path string) (*FileSink, error) {
+	s := &FileSink{path: path, index: make([]offset, 0)}
+	err := s.readIndex()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error when opening audit log %s. Err: %s", path, err)
+	}
+	return s, nil
+}
+
+// Read the seq and offset of every event in the file, and the head of its chain
+func (s *FileSink) readIndex() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return fmt.Errorf("Invalid audit log %s at line %d. Err: %s", s.path, line, err)
+		}
+		s.index = append(s.index, offset{seq: event.Seq, offset: s.size})
+		s.size += int64(len(scanner.Bytes())) + 1
+		s.seq, s.head = event.Seq, event.Hash
+	}
+	return scanner.Err()
+}
+
+// Sign a checkpoint of the chain with `key` after every `every` events, and on Close
+func (s *FileSink) EnableCheckpoints(key []byte, every int) error {
+	file, err := os.OpenFile(checkpointPath(s.path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error when opening checkpoints %s. Err: %s", checkpointPath(s.path), err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+	s.checkpointEvery = every
+	s.checkpoints = file
+	return nil
+}
+
+// Append the events with a single write
+func (s *FileSink) Write(events ...Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	seq, head := s.seq, s.head
+	offsets := make([]offset, 0, len(events))
+	for _, event := range events {
+		seq++
+		event.Seq = seq
+		event.PrevHash = head
+		event.Hash = event.ComputeHash()
+		head = event.Hash
+
+		offsets = append(offsets, offset{seq: seq, offset: s.size + int64(buf.Len())})
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.file.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error when writing audit log %s. Err: %s", s.path, err)
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.seq, s.head = seq, head
+	s.index = append(s.index, offsets...)
+	s.size += int64(buf.Len())
+
+	// the events are written, so a failed checkpoint must not fail the write.
+	// It is retried with the next write, and on Close
+	s.uncheckpointed += len(events)
+	if s.checkpoints != nil && s.uncheckpointed >= s.checkpointEvery {
+		err = s.checkpoint()
+		if err != nil {
+			log.Printf("Error when signing a checkpoint of audit log %s. Err: %s", s.path, err)
+		}
+	}
+	return nil
+}
+
+// Sign a checkpoint of the current head of the chain
+func (s *FileSink) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint()
+}
+
+func (s *FileSink) checkpoint() error {
+	if s.checkpoints == nil || s.uncheckpointed == 0 {
+		return nil
+	}
+
+	checkpoint := Checkpoint{Seq: s.seq, Hash: s.head, Time: time.Now().UTC()}
+	checkpoint.Signature = checkpoint.sign(s.key)
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.checkpoints.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Error when writing checkpoints %s. Err: %s", checkpointPath(s.path), err)
+	}
+	s.uncheckpointed = 0
+	return s.checkpoints.Sync()
+}
+
+// Sign a last checkpoint and close the audit log and its checkpoints.
+// Both files are closed even if the checkpoint fails, the first error is returned
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.checkpoints != nil {
+		err = s.checkpoint()
+		if closeErr := s.checkpoints.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read back every event written so far, oldest first
+func (s *FileSink) Events() ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ReadFile(s.path)
+}
+
+// Call `f` with every event after the seq `after`, oldest first, until it returns false.
+// Reading starts at the first such event, the events before it are not read
+func (s *FileSink) Scan(after uint64, f func(Event) bool) error {
+	s.mu.Lock()
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].seq > after })
+	if i == len(s.index) {
+		s.mu.Unlock()
+		return nil
+	}
+	start, end := s.index[i].offset, s.size
+	s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// only the events written so far, a concurrent write may be in progress
+	scanner := bufio.NewScanner(io.LimitReader(file, end-start))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event Event
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return fmt.Errorf("Invalid audit log %s. Err: %s", s.path, err)
+		}
+		if !f(event) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Read every event of the audit log at `path`, oldest first
+func ReadFile(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make([]Event, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid audit log %s at line %d. Err: %s", path, line, err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"time"
+)
+
+// Reader is a Sink whose events can be read back, oldest first
+type Reader interface {
+	Sink
+	Events() ([]Event, error)
+	// Call `f` with every event after the seq `after`, oldest first, until it returns false
+	Scan(after uint64, f func(Event) bool) error
+}
+
+// Query selects audit events. Empty fields match every event
+type Query struct {
+	Assigner    string
+	Target      string
+	KLPD        string
+	SatuanKerja string
+	Role        string // requested, held before or held after
+	Outcome     string
+	From        time.Time // inclusive
+	To          time.Time // exclusive
+
+	After uint64 // only events after this seq, see Read
+	Limit int    // at most this many events, 0 for no limit
+}
+
+// Whether the event matches every filter of the query
+func (q Query) Match(e Event) bool {
+	switch {
+	case q.Assigner != "" && e.Assigner != q.Assigner,
+		q.Target != "" && e.Target != q.Target,
+		q.KLPD != "" && e.KLPD != q.KLPD,
+		q.SatuanKerja != "" && e.SatuanKerja != q.SatuanKerja,
+		q.Outcome != "" && e.Outcome != q.Outcome,
+		!q.From.IsZero() && e.Time.Before(q.From),
+		!q.To.IsZero() && !e.Time.Before(q.To):
+		return false
+	}
+	if q.Role == "" {
+		return true
+	}
+	for _, roles := range [][]string{e.Requested, e.RolesBefore, e.RolesAfter} {
+		for _, role := range roles {
+			if role == q.Role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the events matching the query, oldest first, from q.After on. Stops reading at the end of the page.
+// Events are in seq order, which is not strictly time order, so q.To doesn't end the scan
+// If there are more than q.Limit, `next` is the cursor to pass as q.After for the next page, otherwise 0
+func (q Query) Read(reader Reader) (page []Event, next uint64, err error) {
+	page = make([]Event, 0)
+	err = reader.Scan(q.After, func(event Event) bool {
+		if !q.Match(event) {
+			return true
+		}
+		if q.Limit > 0 && len(page) == q.Limit {
+			next = page[len(page)-1].Seq
+			return false
+		}
+		page = append(page, event)
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return page, next, nil
+}
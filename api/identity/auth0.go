@@ -0,0 +1,256 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/auth0/go-auth0"
+	"github.com/auth0/go-auth0/management"
+)
+
+// The largest page size of the Management API. Lists are read page by page until the last one
+const perPage = 100
+
+// Auth0 implements Provider on top of the Auth0 Management API
+type Auth0 struct {
+	api *management.Management
+}
+
+// Connect to the Auth0 Management API of `domain` using a static management token
+func NewAuth0(domain string, token string) (*Auth0, error) {
+	api, err := management.New(
+		domain,
+		management.WithStaticToken(token),
+
+		// TODO: Connect using CLIENT_ID and CLIENT_SECRET
+		// management.WithClientCredentials(os.Getenv("AUTH0_CLIENT_ID"), os.Getenv("AUTH0_CLIENT_SECRET")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Auth0{api: api}, nil
+}
+
+// translate Auth0 404 responses into ErrNotFound
+func wrapError(err error) error {
+	var mErr management.Error
+	if errors.As(err, &mErr) && mErr.Status() == 404 {
+		return fmt.Errorf("%w: %s", ErrNotFound, err)
+	}
+	return err
+}
+
+func toUser(u *management.User) *User {
+	return &User{ID: u.GetID(), Email: u.GetEmail(), Blocked: u.GetBlocked()}
+}
+
+func toOrganization(o *management.Organization) *Organization {
+	org := &Organization{ID: o.GetID(), Name: o.GetName(), DisplayName: o.GetDisplayName()}
+	if o.Metadata != nil {
+		org.Metadata = *o.Metadata
+	}
+	return org
+}
+
+func toRoles(roleIDs []string) []*management.Role {
+	roles := make([]*management.Role, 0, len(roleIDs))
+	for _, id := range roleIDs {
+		roles = append(roles, &management.Role{ID: auth0.String(id)})
+	}
+	return roles
+}
+
+func (a *Auth0) CreateUser(email string, password string) (*User, error) {
+	newUser := &management.User{
+		Connection: auth0.String("Username-Password-Authentication"),
+		Email:      auth0.String(email),
+		Password:   auth0.String(password),
+	}
+	err := a.api.User.Create(newUser)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return toUser(newUser), nil
+}
+
+func (a *Auth0) ReadUser(id string) (*User, error) {
+	user, err := a.api.User.Read(id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return toUser(user), nil
+}
+
+func (a *Auth0) ListUsers() ([]User, error) {
+	users := make([]User, 0)
+	for page := 0; ; page++ {
+		userList, err := a.api.User.List(management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, user := range userList.Users {
+			users = append(users, *toUser(user))
+		}
+		if !userList.HasNext() {
+			return users, nil
+		}
+	}
+}
+
+func (a *Auth0) DeleteUser(id string) error {
+	return wrapError(a.api.User.Delete(id))
+}
+
+func (a *Auth0) BlockUser(id string, blocked bool) error {
+	return wrapError(a.api.User.Update(id, &management.User{Blocked: auth0.Bool(blocked)}))
+}
+
+func (a *Auth0) UserOrganizations(userID string) ([]Organization, error) {
+	orgs := make([]Organization, 0)
+	for page := 0; ; page++ {
+		orgList, err := a.api.User.Organizations(userID, management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, org := range orgList.Organizations {
+			orgs = append(orgs, *toOrganization(org))
+		}
+		if !orgList.HasNext() {
+			return orgs, nil
+		}
+	}
+}
+
+func (a *Auth0) ListRoles() ([]Role, error) {
+	roles := make([]Role, 0)
+	for page := 0; ; page++ {
+		roleList, err := a.api.Role.List(management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, role := range roleList.Roles {
+			roles = append(roles, Role{ID: role.GetID(), Name: role.GetName()})
+		}
+		if !roleList.HasNext() {
+			return roles, nil
+		}
+	}
+}
+
+func (a *Auth0) CreateRole(name string, description string) (*Role, error) {
+	newRole := &management.Role{
+		Name:        auth0.String(name),
+		Description: auth0.String(description),
+	}
+	err := a.api.Role.Create(newRole)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &Role{ID: newRole.GetID(), Name: newRole.GetName()}, nil
+}
+
+func (a *Auth0) UserRoles(userID string) ([]Role, error) {
+	roles := make([]Role, 0)
+	for page := 0; ; page++ {
+		roleList, err := a.api.User.Roles(userID, management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, role := range roleList.Roles {
+			roles = append(roles, Role{ID: role.GetID(), Name: role.GetName()})
+		}
+		if !roleList.HasNext() {
+			return roles, nil
+		}
+	}
+}
+
+func (a *Auth0) AssignUserRoles(userID string, roleIDs []string) error {
+	return wrapError(a.api.User.AssignRoles(userID, toRoles(roleIDs)))
+}
+
+func (a *Auth0) RemoveUserRoles(userID string, roleIDs []string) error {
+	return wrapError(a.api.User.RemoveRoles(userID, toRoles(roleIDs)))
+}
+
+func (a *Auth0) ListOrganizations() ([]Organization, error) {
+	orgs := make([]Organization, 0)
+	for page := 0; ; page++ {
+		orgList, err := a.api.Organization.List(management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, org := range orgList.Organizations {
+			orgs = append(orgs, *toOrganization(org))
+		}
+		if !orgList.HasNext() {
+			return orgs, nil
+		}
+	}
+}
+
+func (a *Auth0) ReadOrganizationByName(name string) (*Organization, error) {
+	org, err := a.api.Organization.ReadByName(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return toOrganization(org), nil
+}
+
+func (a *Auth0) CreateOrganization(name string, displayName string, metadata map[string]string) (*Organization, error) {
+	newOrganization := &management.Organization{
+		Name:        auth0.String(name),
+		DisplayName: auth0.String(displayName),
+		Metadata:    &metadata,
+	}
+	err := a.api.Organization.Create(newOrganization)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return toOrganization(newOrganization), nil
+}
+
+func (a *Auth0) Members(orgID string) ([]User, error) {
+	users := make([]User, 0)
+	for page := 0; ; page++ {
+		memberList, err := a.api.Organization.Members(orgID, management.PerPage(perPage), management.Page(page))
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, member := range memberList.Members {
+			users = append(users, User{ID: member.GetUserID(), Email: member.GetEmail()})
+		}
+		if !memberList.HasNext() {
+			return users, nil
+		}
+	}
+}
+
+func (a *Auth0) AddMembers(orgID string, userIDs []string) error {
+	return wrapError(a.api.Organization.AddMembers(orgID, userIDs))
+}
+
+func (a *Auth0) RemoveMembers(orgID string, userIDs []string) error {
+	return wrapError(a.api.Organization.DeleteMember(orgID, userIDs))
+}
+
+func (a *Auth0) MemberRoles(orgID string, userID string) ([]Role, error) {
+	roleList, err := a.api.Organization.MemberRoles(orgID, userID)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	roles := make([]Role, 0, len(roleList.Roles))
+	for _, role := range roleList.Roles {
+		roles = append(roles, Role{ID: role.GetID(), Name: role.GetName()})
+	}
+	return roles, nil
+}
+
+func (a *Auth0) AssignMemberRoles(orgID string, userID string, roleIDs []string) error {
+	return wrapError(a.api.Organization.AssignMemberRoles(orgID, userID, roleIDs))
+}
+
+func (a *Auth0) DeleteMemberRoles(orgID string, userID string, roleIDs []string) error {
+	return wrapError(a.api.Organization.DeleteMemberRoles(orgID, userID, roleIDs))
+}
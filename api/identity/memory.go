@@ -0,0 +1,367 @@
+package identity
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Memory is an in-memory Provider for tests and local development.
+// It mimics the Auth0 semantics the API relies on, most notably that
+// reading the roles of a non-member returns ErrNotFound.
+type Memory struct {
+	mu sync.Mutex
+
+	nextID    int
+	users     map[string]*User
+	roles     map[string]*Role
+	orgs      map[string]*Organization
+	userRoles map[string]map[string]bool // userID -> set of tenant role IDs
+
+	// orgID -> userID -> set of role IDs. A user is a member of an organization
+	// iff it has an entry in members[orgID], even with an empty role set.
+	members map[string]map[string]map[string]bool
+}
+
+// Create an empty in-memory provider
+func NewMemory() *Memory {
+	return &Memory{
+		users:     make(map[string]*User),
+		roles:     make(map[string]*Role),
+		orgs:      make(map[string]*Organization),
+		userRoles: make(map[string]map[string]bool),
+		members:   make(map[string]map[string]map[string]bool),
+	}
+}
+
+func (m *Memory) newID(prefix string) string {
+	m.nextID++
+	return fmt.Sprintf("%s%06d", prefix, m.nextID)
+}
+
+func notFound(kind string, id string) error {
+	return fmt.Errorf("%w: %s %s", ErrNotFound, kind, id)
+}
+
+// collect the roles of a role ID set, sorted by name
+func (m *Memory) roleList(ids map[string]bool) []Role {
+	roles := make([]Role, 0, len(ids))
+	for id := range ids {
+		roles = append(roles, *m.roles[id])
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+func (m *Memory) checkRoles(roleIDs []string) error {
+	for _, id := range roleIDs {
+		if _, ok := m.roles[id]; !ok {
+			return notFound("role", id)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateUser(email string, password string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if email == "" || password == "" {
+		return nil, fmt.Errorf("400 Bad Request: email and password are required")
+	}
+	user := &User{ID: m.newID("auth0|"), Email: email}
+	m.users[user.ID] = user
+	m.userRoles[user.ID] = make(map[string]bool)
+
+	created := *user
+	return &created, nil
+}
+
+func (m *Memory) ReadUser(id string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, notFound("user", id)
+	}
+	found := *user
+	return &found, nil
+}
+
+func (m *Memory) ListUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *Memory) DeleteUser(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return notFound("user", id)
+	}
+	delete(m.users, id)
+	delete(m.userRoles, id)
+	for _, members := range m.members {
+		delete(members, id)
+	}
+	return nil
+}
+
+func (m *Memory) BlockUser(id string, blocked bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return notFound("user", id)
+	}
+	user.Blocked = blocked
+	return nil
+}
+
+func (m *Memory) UserOrganizations(userID string) ([]Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return nil, notFound("user", userID)
+	}
+
+	orgs := make([]Organization, 0)
+	for orgID, members := range m.members {
+		if _, ok := members[userID]; ok {
+			orgs = append(orgs, *m.orgs[orgID])
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs, nil
+}
+
+func (m *Memory) ListRoles() ([]Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make(map[string]bool, len(m.roles))
+	for id := range m.roles {
+		ids[id] = true
+	}
+	return m.roleList(ids), nil
+}
+
+func (m *Memory) CreateRole(name string, description string) (*Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, role := range m.roles {
+		if role.Name == name {
+			return nil, fmt.Errorf("409 Conflict: role %s already exists", name)
+		}
+	}
+	role := &Role{ID: m.newID("rol_"), Name: name}
+	m.roles[role.ID] = role
+
+	created := *role
+	return &created, nil
+}
+
+func (m *Memory) UserRoles(userID string) ([]Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, ok := m.userRoles[userID]
+	if !ok {
+		return nil, notFound("user", userID)
+	}
+	return m.roleList(roles), nil
+}
+
+func (m *Memory) AssignUserRoles(userID string, roleIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, ok := m.userRoles[userID]
+	if !ok {
+		return notFound("user", userID)
+	}
+	if err := m.checkRoles(roleIDs); err != nil {
+		return err
+	}
+	for _, id := range roleIDs {
+		roles[id] = true
+	}
+	return nil
+}
+
+func (m *Memory) RemoveUserRoles(userID string, roleIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, ok := m.userRoles[userID]
+	if !ok {
+		return notFound("user", userID)
+	}
+	for _, id := range roleIDs {
+		delete(roles, id)
+	}
+	return nil
+}
+
+func (m *Memory) ListOrganizations() ([]Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orgs := make([]Organization, 0, len(m.orgs))
+	for _, org := range m.orgs {
+		orgs = append(orgs, *org)
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs, nil
+}
+
+func (m *Memory) ReadOrganizationByName(name string) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, org := range m.orgs {
+		if org.Name == name {
+			found := *org
+			return &found, nil
+		}
+	}
+	return nil, notFound("organization", name)
+}
+
+func (m *Memory) CreateOrganization(name string, displayName string, metadata map[string]string) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, org := range m.orgs {
+		if org.Name == name {
+			return nil, fmt.Errorf("409 Conflict: organization %s already exists", name)
+		}
+	}
+	org := &Organization{ID: m.newID("org_"), Name: name, DisplayName: displayName, Metadata: make(map[string]string)}
+	for key, value := range metadata {
+		org.Metadata[key] = value
+	}
+	m.orgs[org.ID] = org
+	m.members[org.ID] = make(map[string]map[string]bool)
+
+	created := *org
+	return &created, nil
+}
+
+func (m *Memory) Members(orgID string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members, ok := m.members[orgID]
+	if !ok {
+		return nil, notFound("organization", orgID)
+	}
+	users := make([]User, 0, len(members))
+	for id := range members {
+		users = append(users, *m.users[id])
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *Memory) AddMembers(orgID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members, ok := m.members[orgID]
+	if !ok {
+		return notFound("organization", orgID)
+	}
+	for _, id := range userIDs {
+		if _, ok := m.users[id]; !ok {
+			return notFound("user", id)
+		}
+	}
+	for _, id := range userIDs {
+		if _, ok := members[id]; !ok {
+			members[id] = make(map[string]bool)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RemoveMembers(orgID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members, ok := m.members[orgID]
+	if !ok {
+		return notFound("organization", orgID)
+	}
+	for _, id := range userIDs {
+		delete(members, id)
+	}
+	return nil
+}
+
+// look up the role set of a member, returning ErrNotFound for non-members
+func (m *Memory) memberRoles(orgID string, userID string) (map[string]bool, error) {
+	members, ok := m.members[orgID]
+	if !ok {
+		return nil, notFound("organization", orgID)
+	}
+	roles, ok := members[userID]
+	if !ok {
+		return nil, notFound("member", userID)
+	}
+	return roles, nil
+}
+
+func (m *Memory) MemberRoles(orgID string, userID string) ([]Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, err := m.memberRoles(orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return m.roleList(roles), nil
+}
+
+func (m *Memory) AssignMemberRoles(orgID string, userID string, roleIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, err := m.memberRoles(orgID, userID)
+	if err != nil {
+		return err
+	}
+	if err := m.checkRoles(roleIDs); err != nil {
+		return err
+	}
+	for _, id := range roleIDs {
+		roles[id] = true
+	}
+	return nil
+}
+
+func (m *Memory) DeleteMemberRoles(orgID string, userID string, roleIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles, err := m.memberRoles(orgID, userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range roleIDs {
+		delete(roles, id)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned (possibly wrapped) by a Provider when the requested
+// user, organization, role or membership does not exist.
+// Use errors.Is(err, ErrNotFound) to check for it.
+var ErrNotFound = errors.New("not found (404)")
+
+// User is the subset of a provider user that the API cares about
+type User struct {
+	ID      string
+	Email   string
+	Blocked bool
+}
+
+// Organization represents a single `KLPD-SatuanKerja` pair
+type Organization struct {
+	ID          string
+	Name        string
+	DisplayName string
+	Metadata    map[string]string
+}
+
+// Role represents both tenant roles (e.g. "Super Admin") and
+// roles a member holds inside an organization
+type Role struct {
+	ID   string
+	Name string
+}
+
+// Provider is the set of identity operations the manager and middleware
+// packages depend on. The Auth0 Management API is one implementation.
+type Provider interface {
+	// Users
+	CreateUser(email string, password string) (*User, error)
+	ReadUser(id string) (*User, error)
+	ListUsers() ([]User, error)
+	DeleteUser(id string) error
+	BlockUser(id string, blocked bool) error
+	UserOrganizations(userID string) ([]Organization, error)
+
+	// Tenant roles
+	ListRoles() ([]Role, error)
+	CreateRole(name string, description string) (*Role, error)
+	UserRoles(userID string) ([]Role, error)
+	AssignUserRoles(userID string, roleIDs []string) error
+	RemoveUserRoles(userID string, roleIDs []string) error
+
+	// Organizations
+	ListOrganizations() ([]Organization, error)
+	ReadOrganizationByName(name string) (*Organization, error)
+	CreateOrganization(name string, displayName string, metadata map[string]string) (*Organization, error)
+	Members(orgID string) ([]User, error)
+	AddMembers(orgID string, userIDs []string) error
+	RemoveMembers(orgID string, userIDs []string) error
+
+	// Organization member roles
+	MemberRoles(orgID string, userID string) ([]Role, error)
+	AssignMemberRoles(orgID string, userID string, roleIDs []string) error
+	DeleteMemberRoles(orgID string, userID string, roleIDs []string) error
+}
@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+)
+
+// AuditSink receives an audit event for every role mutation, see audit.Event
+var AuditSink audit.Sink = audit.Discard{}
+
+const assignerKey contextKey = "assigner"
+
+// Attach the uid of the authenticated assigner to the request, so that it is audited
+func WithAssigner(ctx context.Context, assignerUID string) context.Context {
+	return context.WithValue(ctx, assignerKey, assignerUID)
+}
+
+// The uid of the authenticated assigner, empty for the unprotected endpoints
+func Assigner(r *http.Request) string {
+	assignerUID, _ := r.Context().Value(assignerKey).(string)
+	return assignerUID
+}
+
+// The id of the request, as set by the RequestID middleware or the X-Request-Id header
+func requestID(r *http.Request) string {
+	id := middleware.GetReqID(r.Context())
+	if id == "" {
+		id = r.Header.Get(middleware.RequestIDHeader)
+	}
+	return id
+}
+
+// auditRecord collects the state of every organization a request touches,
+// so that the roles before and after the change can be audited
+type auditRecord struct {
+	r         *http.Request
+	action    string
+	target    string
+	tenant    bool // whether the tenant roles, i.e. Super Admin, are audited
+	block     bool // whether the request blocks the target, recorded with the tenant roles
+	orgs      []*identity.Organization
+	requested map[string][]string // org name, empty for tenant roles -> requested role names
+	before    map[string][]string // org name, empty for tenant roles -> role names held before the change
+}
+
+func newAuditRecord(r *http.Request, action string, target string) *auditRecord {
+	return &auditRecord{r: r, action: action, target: target, requested: make(map[string][]string)}
+}
+
+// Record the current roles of `target` in every organization of `resolved`.
+// `target` may be empty for a user which is yet to be created
+func beginAudit(r *http.Request, action string, target string, user UserInfo, resolved *ResolvedRoles) (*auditRecord, error) {
+	record := newAuditRecord(r, action, target)
+	if user.SuperAdmin {
+		record.addTenant([]string{"Super Admin"})
+	} else {
+		for _, item := range resolved.SatuanKerja {
+			record.addOrg(item.Org, item.Roles)
+		}
+	}
+	return record, record.begin()
+}
+
+// Audit the tenant roles
+func (a *auditRecord) addTenant(requested []string) {
+	a.tenant = true
+	a.requested[""] = requested
+}
+
+// Audit the roles in `org`
+func (a *auditRecord) addOrg(org *identity.Organization, requested []string) {
+	if _, ok := a.requested[org.Name]; !ok {
+		a.orgs = append(a.orgs, org)
+	}
+	a.requested[org.Name] = append(a.requested[org.Name], requested...)
+}
+
+// Record the roles held before the change
+func (a *auditRecord) begin() error {
+	var err error
+	a.before, err = a.snapshot()
+	return err
+}
+
+// The role names `target` currently holds in each audited organization
+func (a *auditRecord) snapshot() (map[string][]string, error) {
+	held := make(map[string][]string)
+	if a.target == "" {
+		return held, nil
+	}
+
+	if a.tenant {
+		roleList, err := Provider.UserRoles(a.target)
+		if err != nil && !errors.Is(err, identity.ErrNotFound) {
+			return nil, err
+		}
+		held[""] = roleNames(roleList)
+	}
+
+	for _, org := range a.orgs {
+		roleList, err := Provider.MemberRoles(org.ID, a.target)
+		if err != nil && !errors.Is(err, identity.ErrNotFound) {
+			return nil, err
+		}
+		held[org.Name] = roleNames(roleList)
+	}
+	return held, nil
+}
+
+// An event for every audited organization with the given outcome
+func (a *auditRecord) events(outcome string, errList []error) []audit.Event {
+	after, err := a.snapshot()
+	if err != nil {
+		errList = append(errList, err)
+	}
+
+	events := make([]audit.Event, 0)
+	now := time.Now().UTC()
+	if a.tenant {
+		event := newEvent(a.r, now, a.action, a.target, "", "", outcome, errList)
+		event.Blocked = a.block
+		events = append(events, event)
+	}
+	for _, org := range a.orgs {
+		klpd, satuanKerja, _ := SatuanKerjaOf(*org)
+		event := newEvent(a.r, now, a.action, a.target, klpd, satuanKerja, outcome, errList)
+		event.Org = org.Name
+		events = append(events, event)
+	}
+	for i, event := range events {
+		events[i].RolesBefore = a.before[event.Org]
+		events[i].RolesAfter = after[event.Org]
+		events[i].Requested = a.requested[event.Org]
+	}
+	return events
+}
+
+// Write the events of every record with a single write, so they are audited together or not at all
+func writeAudit(records []*auditRecord, outcome string, errList []error) error {
+	if len(records) == 0 {
+		return nil
+	}
+	events := make([]audit.Event, 0)
+	for _, record := range records {
+		events = append(events, record.events(outcome, errList)...)
+	}
+	return AuditSink.Write(events...)
+}
+
+// Audit a request which was refused before anything was written.
+// The outcome is logged if it can't be written
+func AuditRejected(r *http.Request, action string, user UserInfo, errList []error) {
+	events := make([]audit.Event, 0)
+	now := time.Now().UTC()
+	if user.SuperAdmin {
+		event := newEvent(r, now, action, user.ID, "", "", audit.OutcomeRejected, errList)
+		event.Requested = []string{"Super Admin"}
+		events = append(events, event)
+	} else {
+		for _, klpd := range user.KLPD {
+			for _, satuanKerja := range klpd.SatuanKerja {
+				event := newEvent(r, now, action, user.ID, klpd.Name, satuanKerja.Name, audit.OutcomeRejected, errList)
+				event.Requested = satuanKerja.Roles
+				events = append(events, event)
+			}
+		}
+	}
+	if len(events) == 0 {
+		events = append(events, newEvent(r, now, action, user.ID, "", "", audit.OutcomeRejected, errList))
+	}
+
+	err := AuditSink.Write(events...)
+	if err != nil {
+		log.Printf("Error when writing audit log, err %s", err)
+	}
+}
+
+// An event in the organization of a KLPD/Satuan Kerja pair, or for the tenant roles if both are empty
+func newEvent(r *http.Request, now time.Time, action string, target string, klpd string, satuanKerja string, outcome string, errList []error) audit.Event {
+	event := audit.Event{
+		Time:        now,
+		RequestID:   requestID(r),
+		Action:      action,
+		Assigner:    Assigner(r),
+		Target:      target,
+		KLPD:        klpd,
+		SatuanKerja: satuanKerja,
+		Outcome:     outcome,
+	}
+	if klpd != "" || satuanKerja != "" {
+		event.Org = orgName(klpd, satuanKerja)
+	}
+	for _, err := range errList {
+		event.Errors = append(event.Errors, err.Error())
+	}
+	return event
+}
+
+func roleNames(roleList []identity.Role) []string {
+	names := make([]string, 0, len(roleList))
+	for _, role := range roleList {
+		names = append(names, role.Name)
+	}
+	return names
+}
@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"spse-role-poc/api/audit"
+)
+
+// An audit event, with its organization split into KLPD and Satuan Kerja as in UserInfo
+type AuditRecord struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request-id"`
+	Action      string    `json:"action"`
+	Assigner    string    `json:"assigner"`
+	Target      string    `json:"target"`
+	KLPD        string    `json:"klpd"`
+	SatuanKerja string    `json:"satuan-kerja"`
+	RolesBefore []string  `json:"roles-before"`
+	RolesAfter  []string  `json:"roles-after"`
+	Requested   []string  `json:"requested"`
+	Blocked     bool      `json:"blocked,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Errors      []string  `json:"errors,omitempty"`
+	Hash        string    `json:"hash"`
+}
+
+func toAuditRecord(event audit.Event) AuditRecord {
+	return AuditRecord{
+		Seq:         event.Seq,
+		Time:        event.Time,
+		RequestID:   event.RequestID,
+		Action:      event.Action,
+		Assigner:    event.Assigner,
+		Target:      event.Target,
+		KLPD:        event.KLPD,
+		SatuanKerja: event.SatuanKerja,
+		RolesBefore: event.RolesBefore,
+		RolesAfter:  event.RolesAfter,
+		Requested:   event.Requested,
+		Blocked:     event.Blocked,
+		Outcome:     event.Outcome,
+		Errors:      event.Errors,
+		Hash:        event.Hash,
+	}
+}
+
+// The maximum page size of /audit
+const maxAuditLimit = 1000
+
+// Handler for querying the audit log
+// Filters: `assigner`, `user`, `klpd`, `satuan-kerja`, `role`, `outcome`, and `from`/`to` in RFC 3339
+// Pages with `limit` (default 100) and `cursor`, the `next-cursor` of the previous page
+// With `format=csv` or `format=ndjson` the events are exported instead, every matching event
+// unless `limit` is given. The next cursor is then sent in the X-Next-Cursor header
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	reader, ok := AuditSink.(audit.Reader)
+	if !ok {
+		http.Error(w, "The audit log can't be queried", http.StatusNotImplemented)
+		return
+	}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be one of json, csv, ndjson", http.StatusBadRequest)
+		return
+	}
+
+	query, errList := parseAuditQuery(params, format == "" || format == "json")
+	if errList != nil {
+		WriteErrorList(w, http.StatusBadRequest, errList)
+		return
+	}
+
+	page, next, err := query.Read(reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	records := make([]AuditRecord, 0, len(page))
+	for _, event := range page {
+		records = append(records, toAuditRecord(event))
+	}
+
+	cursor := ""
+	if next != 0 {
+		cursor = strconv.FormatUint(next, 10)
+	}
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("X-Next-Cursor", cursor)
+		writeAuditCSV(w, records)
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Next-Cursor", cursor)
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			encoder.Encode(record)
+		}
+	default:
+		writeJSON(w, http.StatusOK, struct {
+			Events     []AuditRecord `json:"events"`
+			NextCursor string        `json:"next-cursor,omitempty"`
+		}{records, cursor})
+	}
+}
+
+func parseAuditQuery(params url.Values, paged bool) (audit.Query, []error) {
+	query := audit.Query{
+		Assigner:    params.Get("assigner"),
+		Target:      params.Get("user"),
+		KLPD:        params.Get("klpd"),
+		SatuanKerja: params.Get("satuan-kerja"),
+		Role:        params.Get("role"),
+		Outcome:     params.Get("outcome"),
+	}
+	if paged {
+		query.Limit = 100
+	}
+
+	var errList []error
+	var err error
+	if params.Get("from") != "" {
+		query.From, err = time.Parse(time.RFC3339, params.Get("from"))
+		if err != nil {
+			errList = append(errList, fmt.Errorf("Invalid from %s. Err: %s", params.Get("from"), err))
+		}
+	}
+	if params.Get("to") != "" {
+		query.To, err = time.Parse(time.RFC3339, params.Get("to"))
+		if err != nil {
+			errList = append(errList, fmt.Errorf("Invalid to %s. Err: %s", params.Get("to"), err))
+		}
+	}
+	if params.Get("cursor") != "" {
+		query.After, err = strconv.ParseUint(params.Get("cursor"), 10, 64)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("Invalid cursor %s", params.Get("cursor")))
+		}
+	}
+	if params.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || query.Limit <= 0 || query.Limit > maxAuditLimit {
+			errList = append(errList, fmt.Errorf("limit must be between 1 and %d", maxAuditLimit))
+		}
+	}
+	return query, errList
+}
+
+func writeAuditCSV(w http.ResponseWriter, records []AuditRecord) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"seq", "time", "request-id", "action", "assigner", "target", "klpd", "satuan-kerja",
+		"roles-before", "roles-after", "requested", "blocked", "outcome", "errors", "hash"})
+	for _, record := range records {
+		writer.Write([]string{
+			strconv.FormatUint(record.Seq, 10),
+			record.Time.Format(time.RFC3339Nano),
+			record.RequestID,
+			record.Action,
+			record.Assigner,
+			record.Target,
+			record.KLPD,
+			record.SatuanKerja,
+			strings.Join(record.RolesBefore, ";"),
+			strings.Join(record.RolesAfter, ";"),
+			strings.Join(record.Requested, ";"),
+			strconv.FormatBool(record.Blocked),
+			record.Outcome,
+			strings.Join(record.Errors, ";"),
+			record.Hash,
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,439 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"spse-role-poc/api/policy"
+)
+
+// Number of rows of a bulk import validated and applied at the same time
+var BulkConcurrency = 4
+
+const rowAuthorityKey contextKey = "row-authority"
+
+// Attach the middleware checking the authority of the assigner to a bulk import request,
+// so that every row is checked as a request of its own, see ImportUsers
+func WithRowAuthority(ctx context.Context, authority func(http.Handler) http.Handler) context.Context {
+	return context.WithValue(ctx, rowAuthorityKey, authority)
+}
+
+// A single record of a bulk import, numbered by its line in the input.
+// A record with `id` adds roles to an existing user, see AddRolesHandler,
+// otherwise it creates a new user, see CreateUserHandler
+type BulkRow struct {
+	Line int
+	User UserInfo
+	Err  error // the record could not be parsed
+}
+
+// The result of a single row of a bulk import
+type BulkResult struct {
+	Line       int                `json:"line"`
+	Action     string             `json:"action"`
+	ID         string             `json:"id,omitempty"`
+	Email      string             `json:"email,omitempty"`
+	Status     int                `json:"status"`
+	Outcome    string             `json:"outcome"`
+	Message    string             `json:"message,omitempty"`
+	Errors     []string           `json:"errors,omitempty"`
+	Violations []policy.Violation `json:"violations,omitempty"`
+}
+
+// Outcomes of BulkResult
+const (
+	BulkValid   = "valid"   // passed validation, the import was a dry run
+	BulkInvalid = "invalid" // failed validation, not applied
+	BulkApplied = "applied"
+	BulkFailed  = "failed" // passed validation but failed when applied
+)
+
+// The user of the row, by `id` or else by `email`
+func (row BulkRow) key() string {
+	if row.User.ID != "" {
+		return "id:" + row.User.ID
+	}
+	return "email:" + strings.ToLower(row.User.Email)
+}
+
+func (row BulkRow) action() string {
+	if row.User.ID != "" {
+		return "addroles"
+	}
+	return "create"
+}
+
+// Read a bulk import in `format`, either `csv` or `jsonl`.
+// A CSV has a header naming its columns: `id`, `email`, `password`, `klpd`, `satuan-kerja`,
+// `roles` separated by `;` and `superadmin`, so a CSV row holds the roles of a single Satuan Kerja;
+// rows of the same `id`, or `email` without `id`, are merged into the row of their first line.
+// A line of JSON Lines holds a whole UserInfo. Rows which can't be parsed are returned with Err set,
+// an error is only returned if the input can't be read at all
+func ParseBulk(input io.Reader, format string) ([]BulkRow, error) {
+	switch format {
+	case "csv":
+		return parseBulkCSV(input)
+	case "jsonl":
+		return parseBulkJSONL(input)
+	default:
+		return nil, fmt.Errorf("format must be one of csv, jsonl")
+	}
+}
+
+func parseBulkJSONL(input io.Reader) ([]BulkRow, error) {
+	rows := make([]BulkRow, 0)
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := BulkRow{Line: line}
+		err := json.Unmarshal(scanner.Bytes(), &row.User)
+		if err != nil {
+			row.Err = fmt.Errorf("Invalid record. Err: %s", err)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error when reading the import. Err: %s", err)
+	}
+	return rows, nil
+}
+
+var bulkColumns = []string{"id", "email", "password", "klpd", "satuan-kerja", "roles", "superadmin"}
+
+func parseBulkCSV(input io.Reader) ([]BulkRow, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading the CSV header. Err: %s", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, column := range bulkColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown column %s, columns must be one of %s", name, strings.Join(bulkColumns, ", "))
+		}
+		columns[name] = i
+	}
+
+	rows := make([]BulkRow, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return mergeBulkRows(rows), nil
+		}
+		if err != nil {
+			// the position of a record is only known after reading it without error
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, fmt.Errorf("Error when reading the CSV. Err: %s", err)
+			}
+			rows = append(rows, BulkRow{Line: parseErr.StartLine, Err: fmt.Errorf("Invalid record. Err: %s", err)})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		row := BulkRow{Line: line}
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		row.User = UserInfo{ID: field("id"), Email: field("email"), Password: field("password")}
+		if field("superadmin") != "" {
+			row.User.SuperAdmin, err = strconv.ParseBool(field("superadmin"))
+			if err != nil {
+				row.Err = fmt.Errorf("Invalid superadmin %s", field("superadmin"))
+			}
+		}
+		if field("klpd") != "" || field("satuan-kerja") != "" || field("roles") != "" {
+			roles := make([]string, 0)
+			for _, role := range strings.Split(field("roles"), ";") {
+				if strings.TrimSpace(role) != "" {
+					roles = append(roles, strings.TrimSpace(role))
+				}
+			}
+			row.User.KLPD = []KLPDRoles{{
+				Name:        field("klpd"),
+				SatuanKerja: []SatuanKerjaRoles{{Name: field("satuan-kerja"), Roles: roles}},
+			}}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Merge rows of the same user into the row of its first line, the roles of each row are added
+// to the Satuan Kerja it names. A row with a password different from the first is invalid
+func mergeBulkRows(rows []BulkRow) []BulkRow {
+	merged := make([]BulkRow, 0, len(rows))
+	seen := make(map[string]int) // user key -> index in merged
+	for _, row := range rows {
+		key := row.key()
+		i, ok := seen[key]
+		if row.Err != nil || !ok {
+			if row.Err == nil {
+				seen[key] = len(merged)
+			}
+			merged = append(merged, row)
+			continue
+		}
+
+		first := &merged[i].User
+		if row.User.Password != "" && first.Password != "" && row.User.Password != first.Password {
+			row.Err = fmt.Errorf("The password differs from line %d", merged[i].Line)
+			merged = append(merged, row)
+			continue
+		}
+		if first.Password == "" {
+			first.Password = row.User.Password
+		}
+		first.SuperAdmin = first.SuperAdmin || row.User.SuperAdmin
+		for _, klpd := range row.User.KLPD {
+			for _, satker := range klpd.SatuanKerja {
+				first.KLPD = mergeRoles(first.KLPD, klpd.Name, satker)
+			}
+		}
+	}
+	return merged
+}
+
+// Add the roles of `satker` in `klpdName` to `klpdList`
+func mergeRoles(klpdList []KLPDRoles, klpdName string, satker SatuanKerjaRoles) []KLPDRoles {
+	for i := range klpdList {
+		if klpdList[i].Name != klpdName {
+			continue
+		}
+		for j := range klpdList[i].SatuanKerja {
+			if klpdList[i].SatuanKerja[j].Name == satker.Name {
+				klpdList[i].SatuanKerja[j].Roles = append(klpdList[i].SatuanKerja[j].Roles, satker.Roles...)
+				return klpdList
+			}
+		}
+		klpdList[i].SatuanKerja = append(klpdList[i].SatuanKerja, satker)
+		return klpdList
+	}
+	return append(klpdList, KLPDRoles{Name: klpdName, SatuanKerja: []SatuanKerjaRoles{satker}})
+}
+
+// Import every row in two passes: every row is validated first, as a dry run of its handler,
+// then the valid rows are applied through the same handler. Rows are handled `BulkConcurrency`
+// at a time, each applied row is audited as a request of its own with the request id of `r`.
+// With WithRowAuthority, both passes check the authority of the assigner for every row.
+// A dry run of `r` stops after validation. Returns the result of each row, in order
+func ImportUsers(r *http.Request, rows []BulkRow) []BulkResult {
+	results := make([]BulkResult, len(rows))
+	seen := make(map[string]int)
+	for i, row := range rows {
+		results[i] = BulkResult{Line: row.Line, Action: row.action(), ID: row.User.ID, Email: row.User.Email}
+		if row.Err != nil {
+			results[i].fail(http.StatusBadRequest, row.Err)
+			continue
+		}
+
+		// rows of the same user would be validated against the same roles, but applied one after the other
+		key := row.key()
+		if line, ok := seen[key]; ok {
+			results[i].fail(http.StatusBadRequest, fmt.Errorf("The user is already imported in line %d", line))
+			continue
+		}
+		seen[key] = row.Line
+	}
+
+	eachRow(rows, results, func(i int) {
+		results[i].record(serveRow(r, rows[i], true))
+		if results[i].Status == http.StatusOK {
+			results[i].Outcome = BulkValid
+		}
+	})
+	if IsDryRun(r) {
+		return results
+	}
+
+	eachRow(rows, results, func(i int) {
+		if results[i].Outcome != BulkValid {
+			return
+		}
+		results[i].record(serveRow(r, rows[i], false))
+		if results[i].Status < http.StatusBadRequest {
+			results[i].Outcome = BulkApplied
+		}
+	})
+	return results
+}
+
+// Run `f` for every row not found invalid, BulkConcurrency rows at a time
+func eachRow(rows []BulkRow, results []BulkResult, f func(i int)) {
+	concurrency := BulkConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range rows {
+		if results[i].Outcome == BulkInvalid {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (result *BulkResult) fail(status int, err error) {
+	result.Status = status
+	result.Outcome = BulkInvalid
+	result.Errors = append(result.Errors, err.Error())
+}
+
+// Record the response of the handler of a row
+func (result *BulkResult) record(res *rowResponse) {
+	result.Status = res.status
+	if location := res.header.Get("Location"); location != "" {
+		// the user created by CreateUserHandler
+		id := strings.TrimSuffix(strings.TrimPrefix(location, "/users/"), "/roles")
+		result.ID, _ = url.PathUnescape(id)
+	}
+
+	var message struct {
+		Message string `json:"message"`
+		ErrorMessage
+	}
+	if json.Unmarshal(res.body.Bytes(), &message) != nil {
+		// written by http.Error
+		message.Errors = []string{strings.TrimSpace(res.body.String())}
+	}
+	result.Message = message.Message
+	result.Errors = message.Errors
+	result.Violations = message.Violations
+
+	switch {
+	case res.status >= http.StatusInternalServerError:
+		result.Outcome = BulkFailed
+	case res.status >= http.StatusBadRequest:
+		result.Outcome = BulkInvalid
+	}
+}
+
+// Serve a single row with CreateUserHandler or AddRolesHandler,
+// in the context of `r`, i.e. with its assigner, request id and row authority
+func serveRow(r *http.Request, row BulkRow, dryRun bool) *rowResponse {
+	body, _ := json.Marshal(row.User)
+	ctx := context.WithValue(r.Context(), dryRunKey, dryRun)
+	rowReq, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/"+row.action(), bytes.NewReader(body))
+	rowReq.Header = r.Header.Clone()
+	rowReq.Header.Set("Content-Type", "application/json")
+
+	var handler http.Handler = http.HandlerFunc(CreateUserHandler)
+	if row.User.ID != "" {
+		handler = http.HandlerFunc(AddRolesHandler)
+	}
+	if authority, ok := ctx.Value(rowAuthorityKey).(func(http.Handler) http.Handler); ok {
+		handler = authority(handler)
+	}
+
+	res := &rowResponse{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(res, rowReq)
+	return res
+}
+
+// The response of a handler serving a row
+type rowResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (res *rowResponse) Header() http.Header { return res.header }
+
+func (res *rowResponse) Write(b []byte) (int, error) { return res.body.Write(b) }
+
+func (res *rowResponse) WriteHeader(status int) { res.status = status }
+
+// Write the results of a bulk import in `format`, either `csv` or `jsonl`
+func WriteBulkResults(w io.Writer, format string, results []BulkResult) error {
+	if format == "jsonl" {
+		encoder := json.NewEncoder(w)
+		for _, result := range results {
+			err := encoder.Encode(result)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"line", "action", "id", "email", "status", "outcome", "message", "errors"})
+	for _, result := range results {
+		writer.Write([]string{
+			strconv.Itoa(result.Line),
+			result.Action,
+			result.ID,
+			result.Email,
+			strconv.Itoa(result.Status),
+			result.Outcome,
+			result.Message,
+			strings.Join(result.Errors, ";"),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Handler for importing users and their roles in bulk
+// The request body is CSV with `format=csv` or a `Content-Type` of text/csv, otherwise JSON Lines,
+// see ParseBulk. Responds with the result of every row in the same format, see ImportUsers
+func BulkImportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		}
+	}
+
+	rows, err := ParseBulk(r.Body, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 {
+		http.Error(w, "The import cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	results := ImportUsers(r, rows)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	WriteBulkResults(w, format, results)
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	dryRunKey          contextKey = "dry-run"
+	authorityErrorsKey contextKey = "authority-errors"
+)
+
+// Whether the request only asks to validate the change without applying it.
+// Set with `?dry_run=true` or by DryRunOnly
+func IsDryRun(r *http.Request) bool {
+	if r.URL.Query().Get("dry_run") == "true" {
+		return true
+	}
+	dryRun, _ := r.Context().Value(dryRunKey).(bool)
+	return dryRun
+}
+
+// A middleware marking every request as a dry run, see IsDryRun
+func DryRunOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dryRunKey, true)))
+	})
+}
+
+// Attach the errors found by the authority check to a dry run request,
+// so that the handler can report them together with its own
+func WithAuthorityErrors(ctx context.Context, errList []error) context.Context {
+	return context.WithValue(ctx, authorityErrorsKey, errList)
+}
+
+func authorityErrors(ctx context.Context) []error {
+	errList, _ := ctx.Value(authorityErrorsKey).([]error)
+	return errList
+}
+
+// Respond to a dry run with every error found, without applying anything.
+// Authority errors make the response 403, any other error 400.
+func writeDryRun(w http.ResponseWriter, r *http.Request, errList []error) {
+	authErrList := authorityErrors(r.Context())
+	if len(authErrList) != 0 {
+		WriteErrorList(w, http.StatusForbidden, append(authErrList, errList...))
+		return
+	}
+	if len(errList) != 0 {
+		WriteErrorList(w, http.StatusBadRequest, errList)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message":"Validation passed"}`))
+}
+
+// Handler for validating a role configuration without applying it
+// Takes the same request body as CreateUserHandler, or as AddRolesHandler if `id` is set,
+// in which case the current roles of the user are taken into account
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	var user UserInfo
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	errList := RequestRoles(r).ValidateRolesCombination(user, user.ID != "")
+	writeDryRun(w, r, errList)
+}
+
+// Finish validating a change, which is resolved and validated before its first write:
+// a dry run is answered with writeDryRun, and a change with errors is rejected with 400
+// and audited as `action` on `requested`. Returns whether the change may be applied
+func validated(w http.ResponseWriter, r *http.Request, action string, requested UserInfo, errList []error) bool {
+	if IsDryRun(r) {
+		writeDryRun(w, r, errList)
+		return false
+	}
+	if errList != nil {
+		AuditRejected(r, action, requested, errList)
+		WriteErrorList(w, http.StatusBadRequest, errList)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
+)
+
+// Request body of HandoverHandler
+// Scope is a single Satuan Kerja, or a whole KLPD if its `satuan-kerja` is empty
+type HandoverRequest struct {
+	From  string         `json:"from"`
+	To    string         `json:"to"`
+	Scope SatuanKerjaRef `json:"scope"`
+}
+
+func (request HandoverRequest) scopeName() string {
+	if request.Scope.SatuanKerja == "" {
+		return "KLPD " + request.Scope.KLPD
+	}
+	return request.Scope.String()
+}
+
+// The writes of a handover
+type HandoverPlan struct {
+	Roles    []policy.Assignment // the roles of From in the scope
+	Resolved *ResolvedRoles
+}
+
+// Validate handing every role of `request.From` in the scope over to `request.To`:
+// the resulting role configuration of `request.To` is checked against the role rules
+func (rs *RoleSnapshot) PlanHandover(request HandoverRequest) (*HandoverPlan, []error) {
+	if request.From == request.To {
+		return nil, []error{fmt.Errorf("Cannot hand roles over to the same user %s", request.From)}
+	}
+	if request.Scope.KLPD == "" {
+		return nil, []error{fmt.Errorf("The scope must name a KLPD")}
+	}
+
+	source, err := LoadState(request.From)
+	if err != nil {
+		return nil, []error{err}
+	}
+	plan := &HandoverPlan{}
+	for _, a := range source.Assignments {
+		if a.KLPD == request.Scope.KLPD && (request.Scope.SatuanKerja == "" || a.SatuanKerja == request.Scope.SatuanKerja) {
+			plan.Roles = append(plan.Roles, a)
+		}
+	}
+	if len(plan.Roles) == 0 {
+		return nil, []error{fmt.Errorf("User %s has no roles in %s", request.From, request.scopeName())}
+	}
+
+	target, err := LoadState(request.To)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var resolveErrs []error
+	plan.Resolved, resolveErrs = rs.Resolve(UserInfo{KLPD: RoleTree(plan.Roles)})
+	errList := combineErrors(resolveErrs, violationErrors(rs.Policy.Check(target, policy.Change{Add: plan.Roles})))
+	if errList != nil {
+		return nil, errList
+	}
+	return plan, nil
+}
+
+// Handler for handing every role of one user in a Satuan Kerja or KLPD over to another (serah terima)
+// The successor receives exactly the roles of the predecessor in the scope, and the predecessor
+// loses them, leaving the organizations in which it has no role left. Both sides are audited,
+// and if any step fails, every step is rolled back
+func HandoverHandler(w http.ResponseWriter, r *http.Request) {
+	var request HandoverRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	for _, userID := range []string{request.From, request.To} {
+		_, err = Provider.ReadUser(userID)
+		if errors.Is(err, identity.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("User %s not found", userID), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	plan, errList := RequestRoles(r).PlanHandover(request)
+	requested := UserInfo{ID: request.To}
+	if request.Scope.SatuanKerja != "" {
+		requested.KLPD = []KLPDRoles{{
+			Name:        request.Scope.KLPD,
+			SatuanKerja: []SatuanKerjaRoles{{Name: request.Scope.SatuanKerja}},
+		}}
+	}
+	if !validated(w, r, audit.ActionHandover, requested, errList) {
+		return
+	}
+
+	predecessor := newAuditRecord(r, audit.ActionHandover, request.From)
+	successor := newAuditRecord(r, audit.ActionHandover, request.To)
+	for _, item := range plan.Resolved.SatuanKerja {
+		predecessor.addOrg(item.Org, []string{})
+		successor.addOrg(item.Org, item.Roles)
+	}
+	for _, record := range []*auditRecord{predecessor, successor} {
+		err = record.begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	saga := newSaga(predecessor, successor)
+	for _, item := range plan.Resolved.SatuanKerja {
+		err = saga.assignMemberRoles(request.To, item)
+		if err == nil {
+			err = saga.deleteMemberRoles(request.From, item)
+		}
+		if err == nil {
+			err = saga.removeEmptyMembership(request.From, item.Org)
+		}
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"message":"Roles in %s successfully handed over from %s to %s"}`, request.scopeName(), request.From, request.To)))
+}
@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+)
+
+// Action of the audit events written by CleanupMemberships
+const ActionCleanupMemberships = "cleanup-memberships"
+
+// A member of an organization which holds no role in it
+type EmptyMembership struct {
+	UserID string
+	Org    string
+}
+
+// Find every member without roles across all organizations and, unless `dryRun`,
+// remove them from the organization. Returns the memberships found.
+// Stops at the first error, returning the memberships removed so far
+func CleanupMemberships(dryRun bool) ([]EmptyMembership, error) {
+	found := make([]EmptyMembership, 0)
+
+	orgList, err := Provider.ListOrganizations()
+	if err != nil {
+		return found, fmt.Errorf("Error when reading organizations. Err: %s", err)
+	}
+
+	for _, org := range orgList {
+		members, err := Provider.Members(org.ID)
+		if err != nil {
+			return found, fmt.Errorf("Error when reading members of %s. Err: %s", org.Name, err)
+		}
+
+		for _, member := range members {
+			roleList, err := Provider.MemberRoles(org.ID, member.ID)
+			if errors.Is(err, identity.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return found, fmt.Errorf("Error when reading roles of %s in %s. Err: %s", member.ID, org.Name, err)
+			}
+			if len(roleList) != 0 {
+				continue
+			}
+
+			if !dryRun {
+				err = Provider.RemoveMembers(org.ID, []string{member.ID})
+				if err != nil {
+					return found, fmt.Errorf("Error when removing %s from %s. Err: %s", member.ID, org.Name, err)
+				}
+
+				err = AuditSink.Write(audit.Event{
+					Time:        time.Now().UTC(),
+					Action:      ActionCleanupMemberships,
+					Target:      member.ID,
+					Org:         org.Name,
+					RolesBefore: []string{},
+					RolesAfter:  []string{},
+					Outcome:     audit.OutcomeSuccess,
+				})
+				if err != nil {
+					return found, err
+				}
+			}
+			found = append(found, EmptyMembership{UserID: member.ID, Org: org.Name})
+		}
+	}
+	return found, nil
+}
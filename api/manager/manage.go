@@ -2,11 +2,14 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 
-	"github.com/auth0/go-auth0"
-	"github.com/auth0/go-auth0/management"
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
 )
 
 // Handler for New User Creation
@@ -30,77 +33,52 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	errList := ValidateRolesCombination(user)
-	if errList != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-
-		// parse messages into json
-		var errListStr []string
-		for _, err := range errList {
-			errListStr = append(errListStr, err.Error())
-		}
-
-		json.NewEncoder(w).Encode(ErrorMessage{
-			Errors: errListStr,
-		})
+	rs := RequestRoles(r)
+	resolved, errList := rs.ResolveAndValidate(user, false)
+	if !validated(w, r, audit.ActionCreate, user, errList) {
 		return
 	}
 
-	// setup user information
-	newUser := &management.User{
-		Connection: auth0.String("Username-Password-Authentication"),
-		Email:      auth0.String(user.Email),
-		Password:   auth0.String(user.Password),
-		// // User Metadata For Roles
-		// UserMetadata: &map[string]interface{}{
-		// 	"klpd": user.KLPD,
-		// },
+	record, err := beginAudit(r, audit.ActionCreate, "", user, resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Create a new user
-	err = Auth0API.User.Create(newUser)
+	// Create a new user with its roles, rolling everything back on failure
+	saga := newSaga(record)
+	newUser, err := saga.createUser(user.Email, user.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		saga.fail(w, err)
 		return
 	}
 
 	if user.SuperAdmin {
-		err = Auth0API.Role.AssignUsers(RoleID["Super Admin"], []*management.User{newUser})
+		err = saga.grantSuperAdmin(newUser.ID, resolved.SuperAdminRoleID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			saga.fail(w, err)
 			return
 		}
 	} else {
-		for _, klpd := range user.KLPD {
-			for _, satuanKerja := range klpd.SatuanKerja {
-				org, err := Auth0API.Organization.ReadByName(klpd.Name + "-" + satuanKerja.Name)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				err = Auth0API.Organization.AddMembers(*org.ID, []string{*newUser.ID})
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				roleIDs := make([]string, 0)
-				for _, role := range satuanKerja.Roles {
-					roleIDs = append(roleIDs, RoleID[role])
-				}
-				err = Auth0API.Organization.AssignMemberRoles(*org.ID, *newUser.ID, roleIDs)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		for _, item := range resolved.SatuanKerja {
+			err = saga.assignMemberRoles(newUser.ID, item)
+			if err != nil {
+				saga.fail(w, err)
+				return
 			}
 		}
 	}
 
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/users/"+url.PathEscape(newUser.ID)+"/roles")
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf(`{"message":"New user successfully creaded with ID: %s"}`, *newUser.ID)))
+	w.Write([]byte(fmt.Sprintf(`{"message":"New user successfully creaded with ID: %s"}`, newUser.ID)))
 }
 
 // Handler for Adding Roles to existing user
@@ -123,62 +101,47 @@ func AddRolesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	errList := ValidateRolesCombination(user, true)
-	if errList != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-
-		// parse messages into json
-		var errListStr []string
-		for _, err := range errList {
-			errListStr = append(errListStr, err.Error())
-		}
+	rs := RequestRoles(r)
+	resolved, errList := rs.ResolveAndValidate(user, true)
+	if !validated(w, r, audit.ActionAddRoles, user, errList) {
+		return
+	}
 
-		json.NewEncoder(w).Encode(ErrorMessage{
-			Errors: errListStr,
-		})
+	record, err := beginAudit(r, audit.ActionAddRoles, user.ID, user, resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	saga := newSaga(record)
 	if user.SuperAdmin {
-		_user, err := Auth0API.User.Read(user.ID)
+		_, err := Provider.ReadUser(user.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		err = Auth0API.Role.AssignUsers(RoleID["Super Admin"], []*management.User{_user})
+		err = saga.grantSuperAdmin(user.ID, resolved.SuperAdminRoleID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			saga.fail(w, err)
 			return
 		}
 	} else {
-		for _, klpd := range user.KLPD {
-			for _, satuanKerja := range klpd.SatuanKerja {
-				org, err := Auth0API.Organization.ReadByName(klpd.Name + "-" + satuanKerja.Name)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				err = Auth0API.Organization.AddMembers(*org.ID, []string{user.ID})
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				roleIDs := make([]string, 0)
-				for _, role := range satuanKerja.Roles {
-					roleIDs = append(roleIDs, RoleID[role])
-				}
-				err = Auth0API.Organization.AssignMemberRoles(*org.ID, user.ID, roleIDs)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		for _, item := range resolved.SatuanKerja {
+			err = saga.assignMemberRoles(user.ID, item)
+			if err != nil {
+				saga.fail(w, err)
+				return
 			}
 		}
 	}
 
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`{"message":"Roles successfully updated for user with ID: %s"}`, user.ID)))
@@ -187,6 +150,7 @@ func AddRolesHandler(w http.ResponseWriter, r *http.Request) {
 // Handler for Adding Roles to existing user
 // The Existence/Naming of each role is checked
 // However if the role doesn't exist in a user, it will be ignored
+// A user left without roles in a Satuan Kerja is removed from its organization
 func DeleteRolesHandler(w http.ResponseWriter, r *http.Request) {
 	var user UserInfo
 	err := json.NewDecoder(r.Body).Decode(&user)
@@ -203,78 +167,81 @@ func DeleteRolesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "To be deleted Roles cannot be empty", http.StatusBadRequest)
 		return
 	}
+	_, err = Provider.ReadUser(user.ID)
+	if errors.Is(err, identity.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("User %s not found", user.ID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	resolved, errList := RequestRoles(r).Resolve(user)
+	if !validated(w, r, audit.ActionDeleteRoles, user, errList) {
+		return
+	}
+
+	record, err := beginAudit(r, audit.ActionDeleteRoles, user.ID, user, resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	saga := newSaga(record)
 	if user.SuperAdmin {
-		_role, err := Auth0API.Role.Read(RoleID["Super Admin"])
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		err = Auth0API.User.RemoveRoles(user.ID, []*management.Role{_role})
+		err := saga.revokeSuperAdmin(user.ID, resolved.SuperAdminRoleID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			saga.fail(w, err)
 			return
 		}
 	} else {
-		var errors []error
-		// Validate the roles exist
-		for _, klpd := range user.KLPD {
-			for _, satuanKerja := range klpd.SatuanKerja {
-				org_name := klpd.Name + "-" + satuanKerja.Name
-				_, err := Auth0API.Organization.ReadByName(org_name)
-				if err != nil {
-					errors = append(errors, fmt.Errorf("Error when reading %s. Err: %s", org_name, err))
-					continue
-				}
-
-				for _, role := range satuanKerja.Roles {
-					_, ok := RoleID[role]
-					if !ok {
-						errors = append(errors, fmt.Errorf("Role Function in %s-%s not found: %s", klpd.Name, satuanKerja.Name, role))
-					}
-				}
+		for _, item := range resolved.SatuanKerja {
+			err = saga.deleteMemberRoles(user.ID, item)
+			if err == nil {
+				// a member without roles could still log into the organization
+				err = saga.removeEmptyMembership(user.ID, item.Org)
+			}
+			if err != nil {
+				saga.fail(w, err)
+				return
 			}
 		}
+	}
+
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
 
-		if len(errors) > 0 {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"message":"Roles successfully updated for user with ID: %s"}`, user.ID)))
+}
 
-			// parse messages into json
-			var errListStr []string
-			for _, err := range errors {
-				errListStr = append(errListStr, err.Error())
-			}
+// Write `v` as the json response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
 
-			json.NewEncoder(w).Encode(ErrorMessage{
-				Errors: errListStr,
-			})
-			return
-		}
+// Write a list of errors as ErrorMessage
+func WriteErrorList(w http.ResponseWriter, status int, errList []error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
-		for _, klpd := range user.KLPD {
-			for _, satuanKerja := range klpd.SatuanKerja {
-				org_name := klpd.Name + "-" + satuanKerja.Name
-				org, err := Auth0API.Organization.ReadByName(org_name)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Error when reading %s. Err: %s", org_name, err), http.StatusInternalServerError)
-					continue
-				}
+	// parse messages into json
+	var message ErrorMessage
+	for _, err := range errList {
+		message.Errors = append(message.Errors, err.Error())
 
-				roleIDs := make([]string, 0)
-				for _, role := range satuanKerja.Roles {
-					roleIDs = append(roleIDs, RoleID[role])
-				}
-				err = Auth0API.Organization.DeleteMemberRoles(*org.ID, user.ID, roleIDs)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
+		var violation *policy.Violation
+		if errors.As(err, &violation) {
+			message.Violations = append(message.Violations, *violation)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"message":"Roles successfully updated for user with ID: %s"}`, user.ID)))
+	json.NewEncoder(w).Encode(message)
 }
@@ -1,7 +1,10 @@
 package manager
 
 import (
-	"github.com/auth0/go-auth0/management"
+	"sort"
+
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
 )
 
 // User Information
@@ -22,23 +25,80 @@ import (
 //		]
 //	}
 type UserInfo struct {
-	ID       string `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	KLPD     []struct {
-		Name        string `json:"name"`
-		SatuanKerja []struct {
-			Name  string   `json:"name"`
-			Roles []string `json:"roles"`
-		} `json:"satuan-kerja"`
-	} `json:"klpd"`
-	SuperAdmin bool `json:"superadmin"`
+	ID         string      `json:"id"`
+	Email      string      `json:"email"`
+	Password   string      `json:"password,omitempty"`
+	KLPD       []KLPDRoles `json:"klpd"`
+	SuperAdmin bool        `json:"superadmin"`
+}
+
+// Roles of a user in a single KLPD, grouped by Satuan Kerja
+type KLPDRoles struct {
+	Name        string             `json:"name"`
+	SatuanKerja []SatuanKerjaRoles `json:"satuan-kerja"`
+}
+
+// Roles of a user in a single Satuan Kerja
+type SatuanKerjaRoles struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// Flatten the role tree of the user into a list of assignments
+func (user UserInfo) Assignments() []policy.Assignment {
+	assignments := make([]policy.Assignment, 0)
+	for _, klpd := range user.KLPD {
+		for _, satuanKerja := range klpd.SatuanKerja {
+			for _, role := range satuanKerja.Roles {
+				assignments = append(assignments, policy.Assignment{KLPD: klpd.Name, SatuanKerja: satuanKerja.Name, Role: role})
+			}
+		}
+	}
+	return assignments
+}
+
+// Group a list of assignments into the role tree of UserInfo,
+// sorted by KLPD, Satuan Kerja and role name
+func RoleTree(assignments []policy.Assignment) []KLPDRoles {
+	roles := make(map[string]map[string][]string)
+	for _, assignment := range assignments {
+		if roles[assignment.KLPD] == nil {
+			roles[assignment.KLPD] = make(map[string][]string)
+		}
+		roles[assignment.KLPD][assignment.SatuanKerja] = append(roles[assignment.KLPD][assignment.SatuanKerja], assignment.Role)
+	}
+
+	tree := make([]KLPDRoles, 0, len(roles))
+	for _, klpdName := range sortedKeys(roles) {
+		klpd := KLPDRoles{Name: klpdName, SatuanKerja: make([]SatuanKerjaRoles, 0)}
+		for _, satuanKerjaName := range sortedKeys(roles[klpdName]) {
+			roleNames := roles[klpdName][satuanKerjaName]
+			sort.Strings(roleNames)
+			klpd.SatuanKerja = append(klpd.SatuanKerja, SatuanKerjaRoles{Name: satuanKerjaName, Roles: roleNames})
+		}
+		tree = append(tree, klpd)
+	}
+	return tree
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // struct to store a list of error message
+// Violations repeats the errors which are caused by a role rule, together with the rule ID
+// RolledBack lists the steps which were undone after a failed change, see Saga
 type ErrorMessage struct {
-	Errors []string `json:"errors"`
+	Errors     []string           `json:"errors"`
+	Violations []policy.Violation `json:"violations,omitempty"`
+	RolledBack []string           `json:"rolled-back,omitempty"`
 }
 
-// Auth0 Go-SDK API
-var Auth0API *management.Management
+// Identity provider used by every handler.
+// Injected at startup, see identity.NewAuth0
+var Provider identity.Provider
@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
+)
+
+// Request body of OffboardHandler
+type OffboardRequest struct {
+	Block bool `json:"block"` // also block the user from logging in
+}
+
+// What was removed from an offboarded user
+type OffboardReport struct {
+	ID          string      `json:"id"`
+	Removed     []KLPDRoles `json:"removed"`     // the removed roles, grouped as in UserInfo
+	SuperAdmin  bool        `json:"superadmin"`  // whether Super Admin was removed
+	Memberships []string    `json:"memberships"` // the organizations the user was removed from
+	Blocked     bool        `json:"blocked"`
+}
+
+// Every access of a user, as read from the identity provider
+type userAccess struct {
+	orgs       []identity.Organization
+	roles      map[string][]identity.Role // org ID -> roles held in the org
+	superAdmin *identity.Role             // nil unless the user is a Super Admin
+}
+
+func loadUserAccess(userID string) (*userAccess, error) {
+	access := &userAccess{roles: make(map[string][]identity.Role)}
+
+	tenantRoles, err := Provider.UserRoles(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading user roles. Err: %w", err)
+	}
+	for i := range tenantRoles {
+		if tenantRoles[i].Name == "Super Admin" {
+			access.superAdmin = &tenantRoles[i]
+		}
+	}
+
+	access.orgs, err = Provider.UserOrganizations(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading user organizations. Err: %w", err)
+	}
+	for _, org := range access.orgs {
+		roleList, err := Provider.MemberRoles(org.ID, userID)
+		if err != nil && !errors.Is(err, identity.ErrNotFound) {
+			return nil, fmt.Errorf("Error when reading user roles in %s. Err: %w", org.DisplayName, err)
+		}
+		access.roles[org.ID] = roleList
+	}
+	return access, nil
+}
+
+// The report of removing every access of the user
+func (access *userAccess) report(userID string, block bool) *OffboardReport {
+	report := &OffboardReport{
+		ID:          userID,
+		SuperAdmin:  access.superAdmin != nil,
+		Memberships: make([]string, 0, len(access.orgs)),
+		Blocked:     block,
+	}
+
+	removed := make([]policy.Assignment, 0)
+	for _, org := range access.orgs {
+		report.Memberships = append(report.Memberships, org.Name)
+
+		klpdName, satuanKerjaName, _ := SatuanKerjaOf(org)
+		for _, role := range access.roles[org.ID] {
+			removed = append(removed, policy.Assignment{KLPD: klpdName, SatuanKerja: satuanKerjaName, Role: role.Name})
+		}
+	}
+	report.Removed = RoleTree(removed)
+	return report
+}
+
+// Handler for revoking every access of the user `{id}`: its roles and memberships in every
+// organization and Super Admin. With `{"block": true}` the user is blocked as well.
+// Responds with an OffboardReport, or with the report of what would be removed for a dry run
+func OffboardHandler(w http.ResponseWriter, r *http.Request) {
+	var request OffboardRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID := UserIDParam(r)
+	_, err = Provider.ReadUser(userID)
+	if errors.Is(err, identity.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("User %s not found", userID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	access, err := loadUserAccess(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := access.report(userID, request.Block)
+	if IsDryRun(r) {
+		authErrList := authorityErrors(r.Context())
+		if len(authErrList) != 0 {
+			WriteErrorList(w, http.StatusForbidden, authErrList)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	// the tenant roles are always audited, so that the block is recorded even for a user without roles
+	record := newAuditRecord(r, audit.ActionOffboard, userID)
+	record.addTenant([]string{})
+	record.block = request.Block
+	for i := range access.orgs {
+		record.addOrg(&access.orgs[i], []string{})
+	}
+	err = record.begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	saga := newSaga(record)
+	for i := range access.orgs {
+		item := ResolvedSatuanKerja{Org: &access.orgs[i]}
+		for _, role := range access.roles[item.Org.ID] {
+			item.Roles = append(item.Roles, role.Name)
+			item.RoleIDs = append(item.RoleIDs, role.ID)
+		}
+
+		err = saga.deleteMemberRoles(userID, item)
+		if err == nil {
+			err = saga.removeEmptyMembership(userID, item.Org)
+		}
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	if access.superAdmin != nil {
+		err = saga.revokeSuperAdmin(userID, access.superAdmin.ID)
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	if request.Block {
+		err = saga.blockUser(userID)
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
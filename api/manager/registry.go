@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"spse-role-poc/api/policy"
+)
+
+// RoleSnapshot is an immutable view of the role policy together with the
+// role IDs of the identity provider. A request should call RequestRoles once
+// and use the returned snapshot throughout, so that a concurrent reload
+// cannot change the rules halfway through.
+type RoleSnapshot struct {
+	Policy    *policy.Policy
+	Division  map[string]string   // Division maps each `role name` to its division (parent)
+	CanAssign map[string][]string // CanAssign maps each assigner role to the roles it may assign
+	CanRevoke map[string][]string // CanRevoke maps each assigner role to the roles it may revoke
+	RoleID    map[string]string   // RoleID maps each `role name` to its `role id`
+	LoadedAt  time.Time
+}
+
+var activeRoles atomic.Pointer[RoleSnapshot]
+
+// PolicyFile is the path the role policy is (re)loaded from
+var PolicyFile = "policy.json"
+
+// Returns the currently active role snapshot
+func CurrentRoles() *RoleSnapshot {
+	return activeRoles.Load()
+}
+
+const rolesKey contextKey = "roles"
+
+// Pin the role snapshot `rs` for the rest of the request, so that the authority check
+// and the handler decide under the same revision of the policy, see RequestRoles
+func WithRoles(ctx context.Context, rs *RoleSnapshot) context.Context {
+	return context.WithValue(ctx, rolesKey, rs)
+}
+
+// Returns the role snapshot pinned for the request by WithRoles, or the currently active one
+func RequestRoles(r *http.Request) *RoleSnapshot {
+	rs, ok := r.Context().Value(rolesKey).(*RoleSnapshot)
+	if !ok {
+		return CurrentRoles()
+	}
+	return rs
+}
+
+// Build a role snapshot from the role policy and activate it.
+// Every role declared in the policy must exist in the identity provider.
+// On error the previously active snapshot is kept.
+func RoleSetup(p *policy.Policy) error {
+	rolelist, err := Provider.ListRoles()
+	if err != nil {
+		return err
+	}
+
+	roleID := make(map[string]string)
+	for _, role := range rolelist {
+		roleID[role.Name] = role.ID
+	}
+
+	for _, role := range p.Roles() {
+		if _, ok := roleID[role]; !ok {
+			return fmt.Errorf("Role %s declared in the policy does not exist in the identity provider", role)
+		}
+	}
+
+	activeRoles.Store(&RoleSnapshot{
+		Policy:    p,
+		Division:  p.Division(),
+		CanAssign: p.CanAssign,
+		CanRevoke: p.RevokeTable(),
+		RoleID:    roleID,
+		LoadedAt:  time.Now(),
+	})
+	return nil
+}
+
+// Load the role policy from PolicyFile and activate it
+func ReloadPolicy() (*RoleSnapshot, error) {
+	p, err := policy.Load(PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RoleSetup(p)
+	if err != nil {
+		return nil, err
+	}
+	return CurrentRoles(), nil
+}
+
+// Watch PolicyFile and activate every new valid version of it
+func WatchPolicy(interval time.Duration) (stop func()) {
+	return policy.Watch(PolicyFile, interval, CurrentRoles().Policy.Revision, RoleSetup)
+}
+
+// Handler for reloading the role policy from PolicyFile.
+// If the new policy is invalid, the active one is kept and the error is returned
+func ReloadPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	rs, err := ReloadPolicy()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ErrorMessage{
+			Errors: []string{err.Error()},
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"message":"Policy reloaded","revision":"%s"}`, rs.Policy.Revision)))
+}
@@ -0,0 +1,191 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
+)
+
+// The writes needed to bring the roles of a user to a desired state
+type ReplacePlan struct {
+	Change policy.Change
+	Add    *ResolvedRoles // resolved Change.Add and Change.GrantSuperAdmin
+	Remove *ResolvedRoles // resolved Change.Remove and Change.RevokeSuperAdmin
+}
+
+// Compute the difference between the current roles of `user.ID` and the roles in `user`,
+// and validate the resulting role configuration
+func (rs *RoleSnapshot) PlanReplace(user UserInfo) (*ReplacePlan, []error) {
+	errs := make([]error, 0)
+	for _, klpd := range user.KLPD {
+		for _, satuanKerja := range klpd.SatuanKerja {
+			if len(satuanKerja.Roles) == 0 {
+				errs = append(errs, &policy.Violation{
+					RuleID:  policy.RuleEmptyRoles,
+					Message: fmt.Sprintf("Role assignment cannot be empty for KLPD %s Satuan-Kerja %s", klpd.Name, satuanKerja.Name),
+				})
+			}
+		}
+	}
+
+	current, err := LoadState(user.ID)
+	if err != nil {
+		return nil, []error{err}
+	}
+	change := diffState(current, policy.State{SuperAdmin: user.SuperAdmin, Assignments: user.Assignments()})
+
+	plan := &ReplacePlan{Change: change}
+	var addErrs, removeErrs []error
+	plan.Add, addErrs = rs.Resolve(UserInfo{KLPD: RoleTree(change.Add), SuperAdmin: change.GrantSuperAdmin})
+	plan.Remove, removeErrs = rs.Resolve(UserInfo{KLPD: RoleTree(change.Remove), SuperAdmin: change.RevokeSuperAdmin})
+	// unknown roles are reported by the role rules too
+	errs = append(errs, violationErrors(rs.Policy.Check(current, change))...)
+	errList := combineErrors(append(addErrs, removeErrs...), errs)
+	if errList != nil {
+		return nil, errList
+	}
+	return plan, nil
+}
+
+// The change turning `current` into `desired`
+func diffState(current policy.State, desired policy.State) policy.Change {
+	held := make(map[policy.Assignment]bool)
+	for _, a := range current.Assignments {
+		held[a] = true
+	}
+	wanted := make(map[policy.Assignment]bool)
+	for _, a := range desired.Assignments {
+		wanted[a] = true
+	}
+
+	change := policy.Change{
+		GrantSuperAdmin:  desired.SuperAdmin && !current.SuperAdmin,
+		RevokeSuperAdmin: current.SuperAdmin && !desired.SuperAdmin,
+	}
+	for _, a := range desired.Assignments {
+		if !held[a] {
+			held[a] = true
+			change.Add = append(change.Add, a)
+		}
+	}
+	for _, a := range current.Assignments {
+		if !wanted[a] {
+			wanted[a] = true
+			change.Remove = append(change.Remove, a)
+		}
+	}
+	return change
+}
+
+// Handler for replacing every role of the user `{id}`
+// Takes the desired roles in the same format as AddRolesHandler, `id` may be omitted.
+// Only the roles which differ are assigned or removed, and the user is removed from
+// every Satuan Kerja in which it has no role left
+func ReplaceRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var user UserInfo
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := UserIDParam(r)
+	if user.ID != "" && user.ID != id {
+		http.Error(w, "user id does not match the url", http.StatusBadRequest)
+		return
+	}
+	user.ID = id
+
+	_, err = Provider.ReadUser(user.ID)
+	if errors.Is(err, identity.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("User %s not found", user.ID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	plan, errList := RequestRoles(r).PlanReplace(user)
+	if !validated(w, r, audit.ActionReplaceRoles, user, errList) {
+		return
+	}
+
+	desired := make(map[string][]string)
+	for _, klpd := range user.KLPD {
+		for _, satuanKerja := range klpd.SatuanKerja {
+			name := orgName(klpd.Name, satuanKerja.Name)
+			desired[name] = append(desired[name], satuanKerja.Roles...)
+		}
+	}
+
+	record := newAuditRecord(r, audit.ActionReplaceRoles, user.ID)
+	if plan.Change.GrantSuperAdmin || plan.Change.RevokeSuperAdmin {
+		requested := []string{}
+		if user.SuperAdmin {
+			requested = []string{"Super Admin"}
+		}
+		record.addTenant(requested)
+	}
+	for _, items := range [][]ResolvedSatuanKerja{plan.Remove.SatuanKerja, plan.Add.SatuanKerja} {
+		for _, item := range items {
+			if _, ok := record.requested[item.Org.Name]; !ok {
+				record.addOrg(item.Org, desired[item.Org.Name])
+			}
+		}
+	}
+	err = record.begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	saga := newSaga(record)
+	for _, item := range plan.Remove.SatuanKerja {
+		err = saga.deleteMemberRoles(user.ID, item)
+		if err == nil && len(desired[item.Org.Name]) == 0 {
+			err = saga.removeEmptyMembership(user.ID, item.Org)
+		}
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+	if plan.Change.RevokeSuperAdmin {
+		err = saga.revokeSuperAdmin(user.ID, plan.Remove.SuperAdminRoleID)
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	for _, item := range plan.Add.SatuanKerja {
+		err = saga.assignMemberRoles(user.ID, item)
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+	if plan.Change.GrantSuperAdmin {
+		err = saga.grantSuperAdmin(user.ID, plan.Add.SuperAdminRoleID)
+		if err != nil {
+			saga.fail(w, err)
+			return
+		}
+	}
+
+	err = saga.Finish()
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"message":"Roles successfully replaced for user with ID: %s"}`, user.ID)))
+}
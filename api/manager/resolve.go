@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
+)
+
+// Metadata keys of the KLPD and Satuan Kerja of an organization.
+// The name `KLPD-SatuanKerja` can't be split back, as both may contain a "-"
+const (
+	klpdKey        = "klpd"
+	satuanKerjaKey = "satuan-kerja"
+)
+
+// The name of the organization of a KLPD/Satuan Kerja pair
+func orgName(klpd string, satuanKerja string) string {
+	return klpd + "-" + satuanKerja
+}
+
+// The metadata of the organization of a KLPD/Satuan Kerja pair
+func orgMetadata(klpd string, satuanKerja string) map[string]string {
+	return map[string]string{klpdKey: klpd, satuanKerjaKey: satuanKerja}
+}
+
+// The KLPD and Satuan Kerja of the organization, false if it isn't a Satuan Kerja.
+// Organizations created without the metadata are split at the first "-"
+func SatuanKerjaOf(org identity.Organization) (klpd string, satuanKerja string, ok bool) {
+	klpd, ok = org.Metadata[klpdKey]
+	if !ok {
+		return strings.Cut(org.Name, "-")
+	}
+	return klpd, org.Metadata[satuanKerjaKey], true
+}
+
+// Read the organization of a KLPD/Satuan Kerja pair. Pairs may share a name, e.g. `a-b` and `c`
+// with `a` and `b-c`, so an organization of another pair is reported as identity.ErrNotFound
+func ReadSatuanKerja(klpd string, satuanKerja string) (*identity.Organization, error) {
+	name := orgName(klpd, satuanKerja)
+	org, err := Provider.ReadOrganizationByName(name)
+	if err != nil {
+		return nil, err
+	}
+	orgKLPD, orgSatuanKerja, _ := SatuanKerjaOf(*org)
+	if orgKLPD != klpd || orgSatuanKerja != satuanKerja {
+		return nil, fmt.Errorf("%w: organization %s is KLPD %s: Satuan Kerja %s", identity.ErrNotFound, name, orgKLPD, orgSatuanKerja)
+	}
+	return org, nil
+}
+
+// Every organization and role of a request, resolved to their IDs
+// before anything is written
+type ResolvedRoles struct {
+	SuperAdminRoleID string
+	SatuanKerja      []ResolvedSatuanKerja
+}
+
+// A Satuan Kerja of a request with its organization and role IDs
+type ResolvedSatuanKerja struct {
+	KLPD        string
+	SatuanKerja string
+	Org         *identity.Organization
+	Roles       []string // role names
+	RoleIDs     []string // role IDs, in the same order as Roles
+}
+
+// Resolve every KLPD/Satuan Kerja pair of the request to its organization and every
+// role name to its ID. Each organization is read once. Every unknown organization
+// or role is reported, so the request can be rejected before any write
+func (rs *RoleSnapshot) Resolve(user UserInfo) (*ResolvedRoles, []error) {
+	resolved := &ResolvedRoles{SatuanKerja: make([]ResolvedSatuanKerja, 0)}
+	errList := make([]error, 0)
+
+	if user.SuperAdmin {
+		id, ok := rs.RoleID["Super Admin"]
+		if !ok {
+			errList = append(errList, &policy.Violation{
+				RuleID:  policy.RuleUnknownRole,
+				Message: "Role Function not found: Super Admin",
+			})
+		}
+		resolved.SuperAdminRoleID = id
+	}
+
+	orgs := make(map[[2]string]*identity.Organization) // KLPD, Satuan Kerja -> organization
+	for _, klpd := range user.KLPD {
+		for _, satuanKerja := range klpd.SatuanKerja {
+			pair := [2]string{klpd.Name, satuanKerja.Name}
+			org, ok := orgs[pair]
+			if !ok {
+				var err error
+				org, err = ReadSatuanKerja(klpd.Name, satuanKerja.Name)
+				if err != nil {
+					errList = append(errList, fmt.Errorf("Error when reading %s. Err: %s", orgName(klpd.Name, satuanKerja.Name), err))
+					continue
+				}
+				orgs[pair] = org
+			}
+
+			item := ResolvedSatuanKerja{KLPD: klpd.Name, SatuanKerja: satuanKerja.Name, Org: org}
+			for _, role := range satuanKerja.Roles {
+				id, ok := rs.RoleID[role]
+				if !ok {
+					errList = append(errList, &policy.Violation{
+						RuleID:  policy.RuleUnknownRole,
+						Message: fmt.Sprintf("Role Function in %s-%s not found: %s", klpd.Name, satuanKerja.Name, role),
+					})
+					continue
+				}
+				item.Roles = append(item.Roles, role)
+				item.RoleIDs = append(item.RoleIDs, id)
+			}
+			resolved.SatuanKerja = append(resolved.SatuanKerja, item)
+		}
+	}
+
+	if len(errList) != 0 {
+		return nil, errList
+	}
+	return resolved, nil
+}
+
+// Resolve the request and validate the resulting role combination, see
+// Resolve and ValidateRolesCombination
+// Unknown roles are reported by the role rules, so that every other violation is reported too
+func (rs *RoleSnapshot) ResolveAndValidate(user UserInfo, keepOldRoles bool) (*ResolvedRoles, []error) {
+	resolved, errList := rs.Resolve(user)
+	for _, err := range errList {
+		var violation *policy.Violation
+		if !errors.As(err, &violation) {
+			return nil, errList
+		}
+	}
+
+	combinationErrList := rs.checkCombination(user, keepOldRoles)
+	if combinationErrList != nil {
+		return nil, combinationErrList
+	}
+	if errList != nil {
+		return nil, errList
+	}
+	return resolved, nil
+}
@@ -0,0 +1,243 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+)
+
+// A completed step of a role change together with the action undoing it
+type sagaStep struct {
+	description string
+	undo        func() error
+}
+
+// Saga executes the writes of a role change one step at a time and records
+// every completed step, so that a failed change can be undone with Rollback
+// instead of leaving a half-provisioned user behind.
+// The outcome of the saga is audited for every audit record it has.
+type Saga struct {
+	steps  []sagaStep
+	audits []*auditRecord
+}
+
+// Start a saga auditing its outcome with `records`
+func newSaga(records ...*auditRecord) *Saga {
+	return &Saga{audits: records}
+}
+
+// Run `do` and, if it succeeds, record `undo` as the way to revert it
+func (s *Saga) Run(description string, do func() error, undo func() error) error {
+	err := do()
+	if err != nil {
+		return fmt.Errorf("Error when trying to %s. Err: %s", description, err)
+	}
+	s.steps = append(s.steps, sagaStep{description: description, undo: undo})
+	return nil
+}
+
+// Undo every completed step in reverse order.
+// Returns the steps which were rolled back, and the errors of those which could not be
+func (s *Saga) Rollback() (rolledBack []string, errs []error) {
+	rolledBack = make([]string, 0)
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		err := step.undo()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error when rolling back %s. Err: %s", step.description, err))
+			continue
+		}
+		rolledBack = append(rolledBack, step.description)
+	}
+	s.steps = nil
+	return rolledBack, errs
+}
+
+// Roll back the saga after `err` and report what was rolled back
+func (s *Saga) fail(w http.ResponseWriter, err error) {
+	rolledBack, rollbackErrs := s.Rollback()
+
+	message := ErrorMessage{Errors: []string{err.Error()}, RolledBack: rolledBack}
+	for _, rollbackErr := range rollbackErrs {
+		message.Errors = append(message.Errors, rollbackErr.Error())
+	}
+
+	auditErr := writeAudit(s.audits, audit.OutcomeRolledBack, append([]error{err}, rollbackErrs...))
+	if auditErr != nil {
+		message.Errors = append(message.Errors, auditErr.Error())
+	}
+	writeJSON(w, http.StatusInternalServerError, message)
+}
+
+// Audit the completed saga. A change which can't be audited must be rolled back with fail
+func (s *Saga) Finish() error {
+	return writeAudit(s.audits, audit.OutcomeSuccess, nil)
+}
+
+// Create a new user
+func (s *Saga) createUser(email string, password string) (*identity.User, error) {
+	var newUser *identity.User
+	err := s.Run(fmt.Sprintf("create user %s", email), func() error {
+		var err error
+		newUser, err = Provider.CreateUser(email, password)
+		if err == nil {
+			for _, record := range s.audits {
+				if record.target == "" {
+					record.target = newUser.ID
+				}
+			}
+		}
+		return err
+	}, func() error {
+		return Provider.DeleteUser(newUser.ID)
+	})
+	return newUser, err
+}
+
+// Grant Super Admin to a user, unless it already has it
+func (s *Saga) grantSuperAdmin(userID string, roleID string) error {
+	held, err := hasTenantRole(userID, roleID)
+	if err != nil || held {
+		return err
+	}
+
+	return s.Run(fmt.Sprintf("grant Super Admin to %s", userID), func() error {
+		return Provider.AssignUserRoles(userID, []string{roleID})
+	}, func() error {
+		return Provider.RemoveUserRoles(userID, []string{roleID})
+	})
+}
+
+// Revoke Super Admin from a user, if it has it
+func (s *Saga) revokeSuperAdmin(userID string, roleID string) error {
+	held, err := hasTenantRole(userID, roleID)
+	if err != nil || !held {
+		return err
+	}
+
+	return s.Run(fmt.Sprintf("revoke Super Admin from %s", userID), func() error {
+		return Provider.RemoveUserRoles(userID, []string{roleID})
+	}, func() error {
+		return Provider.AssignUserRoles(userID, []string{roleID})
+	})
+}
+
+// Add the user to the organization and assign the roles it does not hold yet
+func (s *Saga) assignMemberRoles(userID string, item ResolvedSatuanKerja) error {
+	org := item.Org
+	held, member, err := heldMemberRoles(org.ID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !member {
+		err = s.Run(fmt.Sprintf("add %s to %s", userID, org.Name), func() error {
+			return Provider.AddMembers(org.ID, []string{userID})
+		}, func() error {
+			return Provider.RemoveMembers(org.ID, []string{userID})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	names, roleIDs := make([]string, 0), make([]string, 0)
+	for i, id := range item.RoleIDs {
+		if !held[id] {
+			names = append(names, item.Roles[i])
+			roleIDs = append(roleIDs, id)
+		}
+	}
+	if len(roleIDs) == 0 {
+		return nil
+	}
+
+	return s.Run(fmt.Sprintf("assign %s to %s in %s", strings.Join(names, ", "), userID, org.Name), func() error {
+		return Provider.AssignMemberRoles(org.ID, userID, roleIDs)
+	}, func() error {
+		return Provider.DeleteMemberRoles(org.ID, userID, roleIDs)
+	})
+}
+
+// Remove the roles the user holds in the organization. Roles it does not hold are ignored
+func (s *Saga) deleteMemberRoles(userID string, item ResolvedSatuanKerja) error {
+	org := item.Org
+	held, _, err := heldMemberRoles(org.ID, userID)
+	if err != nil {
+		return err
+	}
+
+	names, roleIDs := make([]string, 0), make([]string, 0)
+	for i, id := range item.RoleIDs {
+		if held[id] {
+			names = append(names, item.Roles[i])
+			roleIDs = append(roleIDs, id)
+		}
+	}
+	if len(roleIDs) == 0 {
+		return nil
+	}
+
+	return s.Run(fmt.Sprintf("remove %s from %s in %s", strings.Join(names, ", "), userID, org.Name), func() error {
+		return Provider.DeleteMemberRoles(org.ID, userID, roleIDs)
+	}, func() error {
+		return Provider.AssignMemberRoles(org.ID, userID, roleIDs)
+	})
+}
+
+// Block the user from logging in
+func (s *Saga) blockUser(userID string) error {
+	return s.Run(fmt.Sprintf("block %s", userID), func() error {
+		return Provider.BlockUser(userID, true)
+	}, func() error {
+		return Provider.BlockUser(userID, false)
+	})
+}
+
+// Remove the user from the organization if it holds no role there anymore
+func (s *Saga) removeEmptyMembership(userID string, org *identity.Organization) error {
+	held, member, err := heldMemberRoles(org.ID, userID)
+	if err != nil || !member || len(held) != 0 {
+		return err
+	}
+
+	return s.Run(fmt.Sprintf("remove %s from %s", userID, org.Name), func() error {
+		return Provider.RemoveMembers(org.ID, []string{userID})
+	}, func() error {
+		return Provider.AddMembers(org.ID, []string{userID})
+	})
+}
+
+// The role IDs a user holds in an organization, and whether it is a member at all
+func heldMemberRoles(orgID string, userID string) (map[string]bool, bool, error) {
+	held := make(map[string]bool)
+	roleList, err := Provider.MemberRoles(orgID, userID)
+	if err != nil {
+		if errors.Is(err, identity.ErrNotFound) {
+			return held, false, nil
+		}
+		return nil, false, err
+	}
+
+	for _, role := range roleList {
+		held[role.ID] = true
+	}
+	return held, true, nil
+}
+
+func hasTenantRole(userID string, roleID string) (bool, error) {
+	roleList, err := Provider.UserRoles(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roleList {
+		if role.ID == roleID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
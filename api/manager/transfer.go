@@ -0,0 +1,179 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/policy"
+)
+
+// A single Satuan Kerja, named as in UserInfo
+type SatuanKerjaRef struct {
+	KLPD        string `json:"klpd"`
+	SatuanKerja string `json:"satuan-kerja"`
+}
+
+func (ref SatuanKerjaRef) String() string {
+	return fmt.Sprintf("KLPD %s: Satuan Kerja %s", ref.KLPD, ref.SatuanKerja)
+}
+
+// Request body of TransferHandler
+// Roles may be omitted to transfer every role held in From
+type TransferRequest struct {
+	From  SatuanKerjaRef `json:"from"`
+	To    SatuanKerjaRef `json:"to"`
+	Roles []string       `json:"roles"`
+}
+
+// The writes of a transfer
+type TransferPlan struct {
+	Roles  []string
+	Change policy.Change
+	From   ResolvedSatuanKerja
+	To     ResolvedSatuanKerja
+}
+
+// Combine the errors of resolving a request with the violations of its role rules.
+// Errors other than violations (i.e. unknown organizations) are reported on their own,
+// unknown roles are reported by the role rules as well
+func combineErrors(resolveErrs []error, ruleErrs []error) []error {
+	for _, err := range resolveErrs {
+		var violation *policy.Violation
+		if !errors.As(err, &violation) {
+			return resolveErrs
+		}
+	}
+	if len(ruleErrs) != 0 {
+		return ruleErrs
+	}
+	if len(resolveErrs) != 0 {
+		return resolveErrs
+	}
+	return nil
+}
+
+// Validate moving the roles of `userID` from one Satuan Kerja to another as a single change:
+// the roles are removed from `From` and assigned in `To` in the same role configuration
+func (rs *RoleSnapshot) PlanTransfer(userID string, request TransferRequest) (*TransferPlan, []error) {
+	if request.From == request.To {
+		return nil, []error{fmt.Errorf("Cannot transfer roles to the same Satuan Kerja %s", request.From)}
+	}
+
+	current, err := LoadState(userID)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	held := make(map[string]bool)
+	heldRoles := make([]string, 0)
+	for _, a := range current.Assignments {
+		if a.KLPD == request.From.KLPD && a.SatuanKerja == request.From.SatuanKerja {
+			held[a.Role] = true
+			heldRoles = append(heldRoles, a.Role)
+		}
+	}
+
+	roles := request.Roles
+	if len(roles) == 0 {
+		roles = heldRoles
+	}
+	errList := make([]error, 0)
+	if len(roles) == 0 {
+		errList = append(errList, fmt.Errorf("User has no roles in %s", request.From))
+	}
+	for _, role := range roles {
+		if !held[role] {
+			errList = append(errList, fmt.Errorf("User has no role %s in %s", role, request.From))
+		}
+	}
+	if len(errList) != 0 {
+		return nil, errList
+	}
+
+	plan := &TransferPlan{Roles: roles}
+	for _, role := range roles {
+		plan.Change.Remove = append(plan.Change.Remove, policy.Assignment{KLPD: request.From.KLPD, SatuanKerja: request.From.SatuanKerja, Role: role})
+		plan.Change.Add = append(plan.Change.Add, policy.Assignment{KLPD: request.To.KLPD, SatuanKerja: request.To.SatuanKerja, Role: role})
+	}
+
+	resolved, resolveErrs := rs.Resolve(UserInfo{KLPD: RoleTree(append(plan.Change.Remove, plan.Change.Add...))})
+	errList = combineErrors(resolveErrs, violationErrors(rs.Policy.Check(current, plan.Change)))
+	if errList != nil {
+		return nil, errList
+	}
+
+	for _, item := range resolved.SatuanKerja {
+		switch (SatuanKerjaRef{KLPD: item.KLPD, SatuanKerja: item.SatuanKerja}) {
+		case request.From:
+			plan.From = item
+		case request.To:
+			plan.To = item
+		}
+	}
+	return plan, nil
+}
+
+// Handler for transferring roles of the user `{id}` from one Satuan Kerja to another (mutasi)
+// The roles are assigned in `to` before they are removed from `from`, so the user keeps its access
+// throughout. If any step fails, every step is rolled back
+func TransferHandler(w http.ResponseWriter, r *http.Request) {
+	var request TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID := UserIDParam(r)
+	_, err = Provider.ReadUser(userID)
+	if errors.Is(err, identity.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("User %s not found", userID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	plan, errList := RequestRoles(r).PlanTransfer(userID, request)
+	requested := UserInfo{ID: userID, KLPD: []KLPDRoles{{
+		Name:        request.To.KLPD,
+		SatuanKerja: []SatuanKerjaRoles{{Name: request.To.SatuanKerja, Roles: request.Roles}},
+	}}}
+	if !validated(w, r, audit.ActionTransfer, requested, errList) {
+		return
+	}
+
+	record := newAuditRecord(r, audit.ActionTransfer, userID)
+	record.addOrg(plan.From.Org, plan.Roles)
+	record.addOrg(plan.To.Org, plan.Roles)
+	err = record.begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	saga := newSaga(record)
+	err = saga.assignMemberRoles(userID, plan.To)
+	if err == nil {
+		err = saga.deleteMemberRoles(userID, plan.From)
+	}
+	if err == nil {
+		err = saga.removeEmptyMembership(userID, plan.From.Org)
+	}
+	if err == nil {
+		err = saga.Finish()
+	}
+	if err != nil {
+		saga.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`{"message":"Roles successfully transferred for user with ID: %s"}`, userID)))
+}
@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+
+	"spse-role-poc/api/identity"
+)
+
+// Read the current roles of a user in the same format accepted by /addroles
+func ReadUserRoles(userID string) (*UserInfo, error) {
+	user, err := Provider.ReadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := LoadState(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &UserInfo{
+		ID:         user.ID,
+		Email:      user.Email,
+		KLPD:       RoleTree(state.Assignments),
+		SuperAdmin: state.SuperAdmin,
+	}, nil
+}
+
+// The `{id}` of the route, e.g. `auth0|123` for /users/auth0%7C123/roles
+func UserIDParam(r *http.Request) string {
+	id, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil {
+		return chi.URLParam(r, "id")
+	}
+	return id
+}
+
+// Handler for reading the roles of the user `{id}`
+// Responds with the roles grouped by KLPD and Satuan Kerja, see UserInfo
+func UserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := ReadUserRoles(UserIDParam(r))
+	if errors.Is(err, identity.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("User %s not found", UserIDParam(r)), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,375 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+// Explanation of an authority decision made by ValidateRoleAuthority.
+// Returned instead of running the handler when `?explain=true` is set.
+type Explanation struct {
+	Action     string             `json:"action"` // AuthorityAssign or AuthorityRevoke
+	Assigner   string             `json:"assigner"`
+	SuperAdmin bool               `json:"superadmin"`
+	Allowed    bool               `json:"allowed"`
+	Scopes     []ScopeExplanation `json:"scopes"`
+
+	// Decision for granting or revoking Super Admin, if requested
+	Tenant *RoleDecision `json:"tenant,omitempty"`
+	// Decision for the user being changed, if it already exists
+	Target *TargetExplanation `json:"target,omitempty"`
+
+	assignerRoles []policy.Assignment
+}
+
+// Decision for the user being changed: the assigner may not change its own roles,
+// nor the roles of a user holding a role the assigner could not have granted in a KLPD of the request
+type TargetExplanation struct {
+	ID         string `json:"id"`
+	SuperAdmin bool   `json:"superadmin"`
+	Allowed    bool   `json:"allowed"`
+	Rule       string `json:"rule,omitempty"` // ID of the rule which denied the user itself
+	Message    string `json:"message,omitempty"`
+
+	// The roles the user holds in the KLPDs of the request besides the requested ones,
+	// decided as if they were requested
+	Scopes []ScopeExplanation `json:"scopes"`
+}
+
+// Actions of an authority decision
+const (
+	AuthorityAssign = "assign"
+	AuthorityRevoke = "revoke"
+)
+
+// Decisions for a single KLPD/Satuan Kerja of the request
+type ScopeExplanation struct {
+	KLPD        string `json:"klpd"`
+	SatuanKerja string `json:"satuan-kerja"`
+
+	// Whether the assigner is a member of the Satuan Kerja, and with which roles
+	Member        bool     `json:"member"`
+	AssignerRoles []string `json:"assigner-roles"`
+
+	// The roles the assigner holds in other Satuan Kerja whose administrative scope covers this one,
+	// e.g. `Admin PPE (a-a1)` for an Admin PPE administering KLPD a, see policy.Policy.AdminScope
+	InheritedRoles []string `json:"inherited-roles"`
+
+	// Every role the assigner may assign here (or revoke, for AuthorityRevoke), with the roles granting it
+	CanAssign []Grant `json:"can-assign"`
+
+	Roles []RoleDecision `json:"roles"`
+}
+
+// A role which may be assigned, and the assigner roles it comes from
+// ("Super Admin" for the Super Admin contribution)
+type Grant struct {
+	Role      string   `json:"role"`
+	GrantedBy []string `json:"granted-by"`
+}
+
+// Decision for a single requested role
+type RoleDecision struct {
+	Role      string   `json:"role"`
+	Allowed   bool     `json:"allowed"`
+	GrantedBy []string `json:"granted-by,omitempty"`
+	Rule      string   `json:"rule,omitempty"` // ID of the rule which denied the role
+	Message   string   `json:"message,omitempty"`
+}
+
+// Compute the authority decision for `assigner_uid` assigning the roles in `data`, and Super Admin
+// if requested, recording every step. If `data.ID` is an existing user, it may not be the assigner
+// and must not hold roles the assigner could not have granted, see TargetExplanation.
+// Returns an error only if the check itself failed
+func ExplainRoleAuthority(assigner_uid string, data manager.UserInfo) (*Explanation, error) {
+	return explainAuthority(manager.CurrentRoles(), assigner_uid, data, AuthorityAssign)
+}
+
+// Same as ExplainRoleAuthority for revoking the roles in `data`, decided by the CanRevoke table
+// of the policy instead of CanAssign. The target user must not hold roles the assigner could not revoke
+func ExplainRevokeAuthority(assigner_uid string, data manager.UserInfo) (*Explanation, error) {
+	return explainAuthority(manager.CurrentRoles(), assigner_uid, data, AuthorityRevoke)
+}
+
+func explainAuthority(rs *manager.RoleSnapshot, assigner_uid string, data manager.UserInfo, action string) (*Explanation, error) {
+	explanation := &Explanation{Action: action, Assigner: assigner_uid, Allowed: true}
+
+	assigner := policy.State{}
+	if !isClient(assigner_uid) {
+		var err error
+		assigner, err = manager.LoadState(assigner_uid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	explanation.SuperAdmin = assigner.SuperAdmin
+	explanation.assignerRoles = assigner.Assignments
+
+	var err error
+	explanation.Scopes, err = explainScopes(rs, explanation, data.KLPD)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range explanation.Scopes {
+		explanation.Allowed = explanation.Allowed && scope.allowed()
+	}
+
+	if data.SuperAdmin {
+		explanation.Tenant = &RoleDecision{Role: "Super Admin"}
+		if explanation.SuperAdmin {
+			explanation.Tenant.Allowed = true
+			explanation.Tenant.GrantedBy = []string{"Super Admin"}
+		} else {
+			explanation.Tenant.Rule = RuleCannotAssign
+			explanation.Tenant.Message = "Action not allowed: only a Super Admin may grant or revoke Super Admin"
+		}
+		explanation.Allowed = explanation.Allowed && explanation.Tenant.Allowed
+	}
+
+	if data.ID != "" {
+		explanation.Target, err = explainTarget(rs, explanation, data)
+		if err != nil {
+			return nil, err
+		}
+		if explanation.Target != nil {
+			explanation.Allowed = explanation.Allowed && explanation.Target.Allowed
+		}
+	}
+
+	return explanation, nil
+}
+
+// Whether the token subject is a machine-to-machine client, i.e. `{client_id}@clients`, not a user.
+// A client holds no roles, so it has only the authority of its scopes: it may not assign or revoke any role
+func isClient(subject string) bool {
+	return strings.HasSuffix(subject, "@clients")
+}
+
+// Decide every role in `klpdList` for the action of `explanation`, granted by the member roles
+// of the assigner in each organization and by Super Admin
+func explainScopes(rs *manager.RoleSnapshot, explanation *Explanation, klpdList []manager.KLPDRoles) ([]ScopeExplanation, error) {
+	table, rule := rs.CanAssign, RuleCannotAssign
+	if explanation.Action == AuthorityRevoke {
+		table, rule = rs.CanRevoke, RuleCannotRevoke
+	}
+	assigner_uid, superAdmin := explanation.Assigner, explanation.SuperAdmin
+
+	scopes := make([]ScopeExplanation, 0)
+	for _, klpd := range klpdList {
+		for _, satuanKerja := range klpd.SatuanKerja {
+			scope := ScopeExplanation{
+				KLPD:           klpd.Name,
+				SatuanKerja:    satuanKerja.Name,
+				AssignerRoles:  make([]string, 0),
+				InheritedRoles: make([]string, 0),
+				CanAssign:      make([]Grant, 0),
+				Roles:          make([]RoleDecision, 0),
+			}
+
+			org, err := manager.ReadSatuanKerja(klpd.Name, satuanKerja.Name)
+			if errors.Is(err, identity.ErrNotFound) {
+				// no role can be assigned in an organization which doesn't exist
+				for _, role := range satuanKerja.Roles {
+					scope.Roles = append(scope.Roles, RoleDecision{
+						Role:    role,
+						Rule:    RuleUnknownOrganization,
+						Message: fmt.Sprintf("Organization of KLPD %s: Satuan Kerja %s does not exist", klpd.Name, satuanKerja.Name),
+					})
+				}
+				scopes = append(scopes, scope)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// the roles granting assign authority: Super Admin first, then the member roles
+			assigners := make([]string, 0)
+			if superAdmin {
+				assigners = append(assigners, "Super Admin")
+			}
+
+			assignerRoleList, err := manager.Provider.MemberRoles(org.ID, assigner_uid)
+			if err != nil {
+				if !errors.Is(err, identity.ErrNotFound) {
+					return nil, err
+				}
+			} else {
+				scope.Member = true
+				for _, role := range assignerRoleList {
+					scope.AssignerRoles = append(scope.AssignerRoles, role.Name)
+					assigners = append(assigners, role.Name)
+				}
+			}
+
+			// then the roles administering this Satuan Kerja from another one
+			for _, a := range explanation.assignerRoles {
+				if a.KLPD == klpd.Name && a.SatuanKerja == satuanKerja.Name {
+					continue
+				}
+				adminScope := rs.Policy.AdminScopeOf(a.Role)
+				if adminScope == policy.ScopeGlobal || (adminScope == policy.ScopeKLPD && a.KLPD == klpd.Name) {
+					scope.InheritedRoles = append(scope.InheritedRoles, fmt.Sprintf("%s (%s-%s)", a.Role, a.KLPD, a.SatuanKerja))
+					if !contains(assigners, a.Role) {
+						assigners = append(assigners, a.Role)
+					}
+				}
+			}
+
+			grantedBy := make(map[string][]string)
+			for _, assigner := range assigners {
+				for _, role := range table[assigner] {
+					if _, ok := grantedBy[role]; !ok {
+						scope.CanAssign = append(scope.CanAssign, Grant{Role: role})
+					}
+					grantedBy[role] = append(grantedBy[role], assigner)
+				}
+			}
+			for i := range scope.CanAssign {
+				scope.CanAssign[i].GrantedBy = grantedBy[scope.CanAssign[i].Role]
+			}
+
+			for _, role := range satuanKerja.Roles {
+				decision := RoleDecision{Role: role, GrantedBy: grantedBy[role]}
+				switch {
+				case !scope.Member && len(scope.InheritedRoles) == 0 && !superAdmin:
+					decision.Rule = RuleNoAdminAccess
+					decision.Message = fmt.Sprintf("User has no administrator access in KLPD %s: Satuan Kerja %s", klpd.Name, satuanKerja.Name)
+				case len(decision.GrantedBy) == 0:
+					decision.Rule = rule
+					decision.Message = fmt.Sprintf("Action not allowed: cannot %s %s in KLPD %s: Satuan Kerja %s", explanation.Action, role, klpd.Name, satuanKerja.Name)
+				default:
+					decision.Allowed = true
+				}
+
+				scope.Roles = append(scope.Roles, decision)
+			}
+
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (scope ScopeExplanation) allowed() bool {
+	for _, decision := range scope.Roles {
+		if !decision.Allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Decide whether the assigner may change the existing user `data.ID`, i.e. whether it isn't
+// the assigner itself and the assigner may assign (or revoke) every role it holds in the KLPDs of the request.
+// Roles in the request are already decided in `explanation`, roles in other KLPDs are not changed.
+// Returns nil if the user doesn't exist
+func explainTarget(rs *manager.RoleSnapshot, explanation *Explanation, data manager.UserInfo) (*TargetExplanation, error) {
+	target := &TargetExplanation{ID: data.ID, Allowed: true, Scopes: make([]ScopeExplanation, 0)}
+	if data.ID == explanation.Assigner {
+		target.Allowed = false
+		target.Rule = RuleSelfAssignment
+		target.Message = "Action not allowed: cannot change own roles"
+		return target, nil
+	}
+
+	current, err := manager.LoadState(data.ID)
+	if errors.Is(err, identity.ErrNotFound) {
+		// reported by the handler
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	target.SuperAdmin = current.SuperAdmin
+	if target.SuperAdmin && !explanation.SuperAdmin && !data.SuperAdmin {
+		target.Allowed = false
+		target.Rule = RuleTargetOutranks
+		target.Message = fmt.Sprintf("Action not allowed: user %s is a Super Admin", data.ID)
+	}
+
+	requested := make(map[policy.Assignment]bool)
+	for _, a := range data.Assignments() {
+		requested[a] = true
+	}
+	changed := make(map[string]bool)
+	for _, klpd := range data.KLPD {
+		changed[klpd.Name] = true
+	}
+	held := make([]policy.Assignment, 0)
+	for _, a := range current.Assignments {
+		if changed[a.KLPD] && !requested[a] {
+			held = append(held, a)
+		}
+	}
+
+	target.Scopes, err = explainScopes(rs, explanation, manager.RoleTree(held))
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range target.Scopes {
+		target.Allowed = target.Allowed && scope.allowed()
+	}
+	return target, nil
+}
+
+// The violations behind every denied role, reporting a missing membership or organization once per scope
+func (e *Explanation) Errors() []error {
+	errList := scopeErrors(e.Scopes)
+	if e.Tenant != nil && !e.Tenant.Allowed {
+		errList = append(errList, &policy.Violation{RuleID: e.Tenant.Rule, Scope: "tenant", Message: e.Tenant.Message})
+	}
+	if e.Target == nil {
+		return errList
+	}
+	if e.Target.Rule != "" {
+		errList = append(errList, &policy.Violation{RuleID: e.Target.Rule, Scope: "user " + e.Target.ID, Message: e.Target.Message})
+	}
+	for _, scope := range e.Target.Scopes {
+		for _, decision := range scope.Roles {
+			if !decision.Allowed {
+				errList = append(errList, &policy.Violation{
+					RuleID:  RuleTargetOutranks,
+					Scope:   fmt.Sprintf("KLPD %s: Satuan Kerja %s", scope.KLPD, scope.SatuanKerja),
+					Message: fmt.Sprintf("Action not allowed: user %s holds %s in KLPD %s: Satuan Kerja %s, which the assigner cannot %s", e.Target.ID, decision.Role, scope.KLPD, scope.SatuanKerja, e.Action),
+				})
+			}
+		}
+	}
+	return errList
+}
+
+func scopeErrors(scopes []ScopeExplanation) []error {
+	errList := make([]error, 0)
+	for _, scope := range scopes {
+		for _, decision := range scope.Roles {
+			if decision.Allowed {
+				continue
+			}
+			errList = append(errList, &policy.Violation{
+				RuleID:  decision.Rule,
+				Scope:   fmt.Sprintf("KLPD %s: Satuan Kerja %s", scope.KLPD, scope.SatuanKerja),
+				Message: decision.Message,
+			})
+			if decision.Rule == RuleNoAdminAccess || decision.Rule == RuleUnknownOrganization {
+				break
+			}
+		}
+	}
+	return errList
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+// A middleware to validate whether the assigner may hand the roles of one user over to another,
+// see checkHandoverAuthority and validateChange
+func ValidateHandoverAuthority(next http.Handler) http.Handler {
+	return validateChange(next, audit.ActionHandover, func(r *http.Request, rs *manager.RoleSnapshot, assigner_uid string) (*manager.UserInfo, []error, error) {
+		var request manager.HandoverRequest
+		if decodeBody(r, &request) != nil {
+			return nil, nil, errInvalidBody
+		}
+
+		errList, err := checkHandoverAuthority(rs, assigner_uid, request)
+		requested := &manager.UserInfo{ID: request.To}
+		if request.Scope.SatuanKerja != "" {
+			requested.KLPD = []manager.KLPDRoles{{
+				Name:        request.Scope.KLPD,
+				SatuanKerja: []manager.SatuanKerjaRoles{{Name: request.Scope.SatuanKerja}},
+			}}
+		}
+		return requested, errList, err
+	})
+}
+
+// Check whether the assigner with `assigner_uid` may hand the roles of `request.From` in the scope
+// over to `request.To`: it must be allowed to revoke them from the predecessor and to assign them
+// to the successor, and neither may hold roles the assigner could not have changed
+func checkHandoverAuthority(rs *manager.RoleSnapshot, assigner_uid string, request manager.HandoverRequest) ([]error, error) {
+	source, err := readTarget(request.From)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readTarget(request.To)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]policy.Assignment, 0)
+	for _, a := range source.Assignments() {
+		if a.KLPD == request.Scope.KLPD && (request.Scope.SatuanKerja == "" || a.SatuanKerja == request.Scope.SatuanKerja) {
+			roles = append(roles, a)
+		}
+	}
+	grant := manager.UserInfo{ID: request.To, KLPD: manager.RoleTree(roles)}
+	revoke := manager.UserInfo{ID: request.From, KLPD: manager.RoleTree(roles)}
+	return checkChangeAuthority(rs, assigner_uid, grant, revoke)
+}
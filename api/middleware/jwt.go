@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -12,6 +13,8 @@ import (
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
+
+	"spse-role-poc/api/manager"
 )
 
 // CustomClaims contains custom data we want from the token.
@@ -64,10 +67,22 @@ func EnsureValidToken() func(next http.Handler) http.Handler {
 	)
 
 	return func(next http.Handler) http.Handler {
-		return middleware.CheckJWT(next)
+		return middleware.CheckJWT(AssignerFromClaims(next))
 	}
 }
 
+// AssignerFromClaims is a middleware taking the assigner from the `sub` of the token
+// validated by EnsureValidToken, see manager.Assigner
+func AssignerFromClaims(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+		if ok && claims.RegisteredClaims.Subject != "" {
+			r = r.WithContext(manager.WithAssigner(r.Context(), claims.RegisteredClaims.Subject))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // HasScope checks whether our claims have a specific scope.
 func (c CustomClaims) HasScope(expectedScope string) bool {
 	result := strings.Split(c.Scope, " ")
@@ -79,3 +94,39 @@ func (c CustomClaims) HasScope(expectedScope string) bool {
 
 	return false
 }
+
+// Scopes of the access tokens of the management API
+const (
+	ScopeUsersCreate = "users:create"
+	ScopeUsersRead   = "users:read"
+	ScopeRolesAssign = "roles:assign"
+	ScopeRolesRevoke = "roles:revoke"
+	ScopePolicyAdmin = "policy:admin"
+)
+
+// RequireScope is a middleware rejecting access tokens which lack any of `scopes`.
+// Must be mounted after EnsureValidToken
+func RequireScope(scopes ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+			if !ok {
+				http.Error(w, "Missing access token", http.StatusUnauthorized)
+				return
+			}
+			customClaims, _ := claims.CustomClaims.(*CustomClaims)
+
+			var errList []error
+			for _, scope := range scopes {
+				if customClaims == nil || !customClaims.HasScope(scope) {
+					errList = append(errList, fmt.Errorf("Missing scope %s", scope))
+				}
+			}
+			if len(errList) != 0 {
+				manager.WriteErrorList(w, http.StatusForbidden, errList)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
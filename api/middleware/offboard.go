@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+)
+
+// A middleware to validate whether the assigner may offboard the user `{id}`,
+// i.e. whether it may revoke every role the user holds, see CheckOffboardAuthority and validateChange
+func ValidateOffboardAuthority(next http.Handler) http.Handler {
+	return validateChange(next, audit.ActionOffboard, func(r *http.Request, rs *manager.RoleSnapshot, assigner_uid string) (*manager.UserInfo, []error, error) {
+		return checkOffboardAuthority(rs, assigner_uid, manager.UserIDParam(r))
+	})
+}
+
+// Check whether the assigner with `assigner_uid` may remove every role of the user `target_uid`.
+// Removing a role requires the authority to revoke it, and removing Super Admin requires Super Admin,
+// see ExplainRevokeAuthority.
+// Returns the current roles of the user together with the roles which may not be removed
+func CheckOffboardAuthority(assigner_uid string, target_uid string) (*manager.UserInfo, []error, error) {
+	return checkOffboardAuthority(manager.CurrentRoles(), assigner_uid, target_uid)
+}
+
+func checkOffboardAuthority(rs *manager.RoleSnapshot, assigner_uid string, target_uid string) (*manager.UserInfo, []error, error) {
+	target, err := readTarget(target_uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	explanation, err := explainAuthority(rs, assigner_uid, *target, AuthorityRevoke)
+	if err != nil {
+		return nil, nil, err
+	}
+	return target, explanation.Errors(), nil
+}
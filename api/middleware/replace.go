@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+// A middleware to validate whether the assigner may replace the roles of the user `{id}`,
+// see checkReplaceAuthority and validateChange
+func ValidateReplaceAuthority(next http.Handler) http.Handler {
+	return validateChange(next, audit.ActionReplaceRoles, func(r *http.Request, rs *manager.RoleSnapshot, assigner_uid string) (*manager.UserInfo, []error, error) {
+		var data manager.UserInfo
+		if decodeBody(r, &data) != nil {
+			return nil, nil, errInvalidBody
+		}
+		data.ID = manager.UserIDParam(r)
+
+		errList, err := checkReplaceAuthority(rs, assigner_uid, data)
+		return &data, errList, err
+	})
+}
+
+// Check whether the assigner with `assigner_uid` may replace the roles of `data.ID` with the roles in `data`:
+// it must be allowed to assign every role the user gains and to revoke every role the user loses,
+// and the user must not hold roles the assigner could not revoke, see ExplainRevokeAuthority
+func checkReplaceAuthority(rs *manager.RoleSnapshot, assigner_uid string, data manager.UserInfo) ([]error, error) {
+	current, err := readTarget(data.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[policy.Assignment]bool)
+	for _, a := range data.Assignments() {
+		kept[a] = true
+	}
+	held := make(map[policy.Assignment]bool)
+	removed := make([]policy.Assignment, 0)
+	for _, a := range current.Assignments() {
+		held[a] = true
+		if !kept[a] {
+			removed = append(removed, a)
+		}
+	}
+	added := make([]policy.Assignment, 0)
+	for _, a := range data.Assignments() {
+		if !held[a] {
+			held[a] = true
+			added = append(added, a)
+		}
+	}
+
+	grant := manager.UserInfo{ID: data.ID, KLPD: manager.RoleTree(added), SuperAdmin: data.SuperAdmin && !current.SuperAdmin}
+	revoke := manager.UserInfo{ID: data.ID, KLPD: manager.RoleTree(removed), SuperAdmin: current.SuperAdmin && !data.SuperAdmin}
+	return checkChangeAuthority(rs, assigner_uid, grant, revoke)
+}
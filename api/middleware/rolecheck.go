@@ -3,142 +3,203 @@ package middleware
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"path"
 	"strings"
 
+	"spse-role-poc/api/identity"
 	"spse-role-poc/api/manager"
 )
 
-// A middleware to validate whether the assigner is allowed to perform such action
+// Rule IDs of the authority checks
+const (
+	RuleNoAdminAccess       = "no-admin-access"
+	RuleUnknownOrganization = "unknown-organization"
+	RuleCannotAssign        = "cannot-assign"
+	RuleCannotRevoke        = "cannot-revoke"
+	RuleSelfAssignment      = "self-assignment"
+	RuleTargetOutranks      = "target-outranks-assigner"
+)
+
+// A middleware to validate whether the assigner is allowed to assign the roles in the request
+// For a dry run (see manager.IsDryRun) the errors are handed to the handler instead
+// With `?explain=true` the decision is explained instead of running the handler, see Explanation
 func ValidateRoleAuthority(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Read the original request body
-		buf, _ := ioutil.ReadAll(r.Body)
-		rdr1 := ioutil.NopCloser(bytes.NewBuffer(buf))
-		rdr2 := ioutil.NopCloser(bytes.NewBuffer(buf))
-
-		// data type to extract token and roles from the request body
-		type Roles struct {
-			KLPD []struct {
-				Name        string `json:"name"`
-				SatuanKerja []struct {
-					Name  string   `json:"name"`
-					Roles []string `json:"roles"`
-				} `json:"satuan-kerja"`
-			} `json:"klpd"`
-		}
+	return validateAuthority(next, AuthorityAssign)
+}
 
-		var data Roles
-		err := json.NewDecoder(rdr1).Decode(&data)
+// Same as ValidateRoleAuthority for revoking the roles in the request,
+// decided by the revoke table of the policy, see policy.Policy.RevokeTable
+func ValidateRevokeAuthority(next http.Handler) http.Handler {
+	return validateAuthority(next, AuthorityRevoke)
+}
+
+func validateAuthority(next http.Handler, action string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data manager.UserInfo
+		err := decodeBody(r, &data)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		token := r.Header.Get("Token")
-		if token == "" {
-			http.Error(w, "Missing Token", http.StatusNotFound)
+		assigner_uid, ok := resolveAssigner(w, r)
+		if !ok {
 			return
 		}
 
-		req, err := http.NewRequest("GET", "https://"+os.Getenv("AUTH0_DOMAIN")+"/userinfo", nil)
-		req.Header.Set("Authorization", "Bearer "+token)
-		res, err := http.DefaultClient.Do(req)
+		// the handler validates the change under the same policy revision
+		rs := manager.RequestRoles(r)
+		r = r.WithContext(manager.WithRoles(r.Context(), rs))
+		explanation, err := explainAuthority(rs, assigner_uid, data, action)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer res.Body.Close()
 
-		if res.StatusCode != http.StatusOK {
-			http.Error(w, res.Status, res.StatusCode)
+		if r.URL.Query().Get("explain") == "true" {
+			status := http.StatusOK
+			if !explanation.Allowed {
+				status = http.StatusForbidden
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(explanation)
 			return
 		}
+		enforceAuthority(w, r, next, auditAction(r), data, explanation.Errors())
+	})
+}
 
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// A check of a role change by validateChange. Returns the change as requested, which a rejection
+// is audited with, and the errors of the authority check
+type changeCheck func(r *http.Request, rs *manager.RoleSnapshot, assigner_uid string) (*manager.UserInfo, []error, error)
+
+var (
+	errInvalidBody = errors.New("Invalid request body")
+	// the user being changed doesn't exist, which is reported by the handler
+	errUnknownTarget = errors.New("Unknown target user")
+)
+
+// A middleware running `check` for the assigner and serving the request only if it found no errors,
+// see enforceAuthority. The handler validates the change under the same role snapshot as the check.
+// A check failing with errUnknownTarget is left to the handler, as nothing can be changed
+func validateChange(next http.Handler, action string, check changeCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assigner_uid, ok := resolveAssigner(w, r)
+		if !ok {
 			return
 		}
 
-		// Retrieve only the sub(assigner uid) key from the response body
-		type jsonResponse struct {
-			Sub string `json:"sub"`
-		}
-		var response jsonResponse
-		err = json.Unmarshal(body, &response)
-		if err != nil {
+		rs := manager.RequestRoles(r)
+		r = r.WithContext(manager.WithRoles(r.Context(), rs))
+		requested, errList, err := check(r, rs, assigner_uid)
+		switch {
+		case errors.Is(err, errInvalidBody):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errUnknownTarget):
+			next.ServeHTTP(w, r)
+		case err != nil:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		default:
+			enforceAuthority(w, r, next, action, *requested, errList)
 		}
-		assigner_uid := response.Sub
+	})
+}
+
+// Decode the JSON request body into `v`, leaving the body to be read again by the handler
+func decodeBody(r *http.Request, v interface{}) error {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+	return json.Unmarshal(buf, v)
+}
+
+// The current roles of the user `user_uid` being changed, errUnknownTarget if it doesn't exist
+func readTarget(user_uid string) (*manager.UserInfo, error) {
+	_, err := manager.Provider.ReadUser(user_uid)
+	if errors.Is(err, identity.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", errUnknownTarget, user_uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manager.ReadUserRoles(user_uid)
+}
 
-		isSuperAdmin := false
-		rolelist, err := manager.Auth0API.User.Roles(assigner_uid)
+// Serve the request if the authority check found no errors, otherwise reject it with 403
+// and audit it as `action` on `requested`. A dry run is served with the errors, see manager.IsDryRun
+func enforceAuthority(w http.ResponseWriter, r *http.Request, next http.Handler, action string, requested manager.UserInfo, errList []error) {
+	if manager.IsDryRun(r) {
+		next.ServeHTTP(w, r.WithContext(manager.WithAuthorityErrors(r.Context(), errList)))
+		return
+	}
+	if len(errList) != 0 {
+		manager.AuditRejected(r, action, requested, errList)
+		manager.WriteErrorList(w, http.StatusForbidden, errList)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// Explain both assigning `grant` and revoking `revoke` under the same role snapshot,
+// returning the errors of both
+func checkChangeAuthority(rs *manager.RoleSnapshot, assigner_uid string, grant manager.UserInfo, revoke manager.UserInfo) ([]error, error) {
+	errList := make([]error, 0)
+	for _, check := range []struct {
+		action string
+		data   manager.UserInfo
+	}{{AuthorityAssign, grant}, {AuthorityRevoke, revoke}} {
+		explanation, err := explainAuthority(rs, assigner_uid, check.data, check.action)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, err
 		}
+		errList = append(errList, explanation.Errors()...)
+	}
+	return errList, nil
+}
 
-		for _, role := range rolelist.Roles {
-			if *role.Name == "Super Admin" {
-				isSuperAdmin = true
-			}
-		}
+// The uid of the assigner, taken from the access token by EnsureValidToken.
+// Writes the error response if the request carries none
+func resolveAssigner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	assigner_uid := manager.Assigner(r)
+	if assigner_uid == "" {
+		http.Error(w, "Missing access token", http.StatusUnauthorized)
+		return "", false
+	}
+	return assigner_uid, true
+}
 
-		for _, klpd := range data.KLPD {
-			for _, satuanKerja := range klpd.SatuanKerja {
-				org, err := manager.Auth0API.Organization.ReadByName(klpd.Name + "-" + satuanKerja.Name)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				canAssignList := make([]string, 0)
-				if isSuperAdmin {
-					canAssignList = append(canAssignList, manager.CanAssign["Super Admin"]...)
-				}
-
-				assignerRoleList, err := manager.Auth0API.Organization.MemberRoles(*org.ID, assigner_uid)
-				if err != nil {
-					if strings.Contains(err.Error(), "404") {
-						if !isSuperAdmin {
-							http.Error(w, fmt.Sprintf("User has no administrator access in KLPD %s: Satuan Kerja %s", klpd.Name, satuanKerja.Name), http.StatusForbidden)
-							return
-						}
-					} else {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-				} else {
-					for _, role := range assignerRoleList.Roles {
-						assignList, ok := manager.CanAssign[*role.Name]
-						if ok {
-							canAssignList = append(canAssignList, assignList...)
-						}
-					}
-				}
-
-				for _, role := range satuanKerja.Roles {
-					found := false
-					for _, assignList := range canAssignList {
-						if role == assignList {
-							found = true
-						}
-					}
-
-					if !found {
-						http.Error(w, "Action not allowed", http.StatusForbidden)
-						return
-					}
-				}
-			}
-		}
+// The audited action of a protected endpoint, e.g. `addroles` for `/addroles-protected`
+func auditAction(r *http.Request) string {
+	return strings.TrimSuffix(path.Base(r.URL.Path), "-protected")
+}
 
-		// Copy back the original data to request body
-		r.Body = rdr2
-		next.ServeHTTP(w, r)
+// Check whether the assigner with `assigner_uid` may assign every role in `data`.
+// Returns every role which is not allowed, or an error if the check itself failed.
+// See ExplainRoleAuthority for how the decision is made
+func CheckRoleAuthority(assigner_uid string, data manager.UserInfo) ([]error, error) {
+	explanation, err := ExplainRoleAuthority(assigner_uid, data)
+	if err != nil {
+		return nil, err
+	}
+	return explanation.Errors(), nil
+}
+
+// A middleware checking every row of a bulk import with ValidateRoleAuthority,
+// as if it were sent to `/create-protected` or `/addroles-protected`, see manager.ImportUsers
+func ValidateImportAuthority(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := resolveAssigner(w, r); !ok {
+			return
+		}
+		// every row is validated and applied under the same policy revision
+		ctx := manager.WithRoles(r.Context(), manager.RequestRoles(r))
+		next.ServeHTTP(w, r.WithContext(manager.WithRowAuthority(ctx, ValidateRoleAuthority)))
 	})
 }
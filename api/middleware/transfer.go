@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+// A middleware to validate whether the assigner may transfer the roles of the user `{id}`,
+// see checkTransferAuthority and validateChange
+func ValidateTransferAuthority(next http.Handler) http.Handler {
+	return validateChange(next, audit.ActionTransfer, func(r *http.Request, rs *manager.RoleSnapshot, assigner_uid string) (*manager.UserInfo, []error, error) {
+		var request manager.TransferRequest
+		if decodeBody(r, &request) != nil {
+			return nil, nil, errInvalidBody
+		}
+		userID := manager.UserIDParam(r)
+
+		errList, err := checkTransferAuthority(rs, assigner_uid, userID, request)
+		requested := &manager.UserInfo{ID: userID, KLPD: []manager.KLPDRoles{{
+			Name:        request.To.KLPD,
+			SatuanKerja: []manager.SatuanKerjaRoles{{Name: request.To.SatuanKerja, Roles: request.Roles}},
+		}}}
+		return requested, errList, err
+	})
+}
+
+// Check whether the assigner with `assigner_uid` may transfer the roles of `userID`:
+// it must be allowed to revoke the roles in `request.From` and to assign them in `request.To`,
+// and the user must not hold roles the assigner could not revoke, see ExplainRevokeAuthority.
+// Without `request.Roles`, every role the user holds in `request.From` is checked
+func checkTransferAuthority(rs *manager.RoleSnapshot, assigner_uid string, userID string, request manager.TransferRequest) ([]error, error) {
+	roles := request.Roles
+	if len(roles) == 0 {
+		current, err := readTarget(userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range current.Assignments() {
+			if a.KLPD == request.From.KLPD && a.SatuanKerja == request.From.SatuanKerja {
+				roles = append(roles, a.Role)
+			}
+		}
+	}
+
+	from := make([]policy.Assignment, 0)
+	to := make([]policy.Assignment, 0)
+	for _, role := range roles {
+		from = append(from, policy.Assignment{KLPD: request.From.KLPD, SatuanKerja: request.From.SatuanKerja, Role: role})
+		to = append(to, policy.Assignment{KLPD: request.To.KLPD, SatuanKerja: request.To.SatuanKerja, Role: role})
+	}
+	grant := manager.UserInfo{ID: userID, KLPD: manager.RoleTree(to)}
+	revoke := manager.UserInfo{ID: userID, KLPD: manager.RoleTree(from)}
+	return checkChangeAuthority(rs, assigner_uid, grant, revoke)
+}
@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"fmt"
+)
+
+// Rule IDs of the checks built into Check.
+// The remaining rules are the constraints of the policy.
+const (
+	RuleUnknownRole = "unknown-role"
+	RuleEmptyRoles  = "empty-roles"
+	RuleSuperAdmin  = "superadmin-exclusive"
+)
+
+// State is the role configuration of a single user
+type State struct {
+	SuperAdmin  bool
+	Assignments []Assignment
+}
+
+// Change is a requested delta to the State of a single user
+type Change struct {
+	Add              []Assignment
+	Remove           []Assignment
+	GrantSuperAdmin  bool
+	RevokeSuperAdmin bool
+}
+
+// Apply the change to `current` and return the resulting state.
+// Added assignments are marked as Requested, existing ones are not.
+func (c Change) Apply(current State) State {
+	removed := make(map[Assignment]bool)
+	for _, a := range c.Remove {
+		a.Requested = false
+		removed[a] = true
+	}
+
+	result := State{SuperAdmin: current.SuperAdmin}
+	if c.GrantSuperAdmin {
+		result.SuperAdmin = true
+	}
+	if c.RevokeSuperAdmin {
+		result.SuperAdmin = false
+	}
+
+	held := make(map[Assignment]bool)
+	for _, a := range current.Assignments {
+		a.Requested = false
+		if removed[a] || held[a] {
+			continue
+		}
+		held[a] = true
+		result.Assignments = append(result.Assignments, a)
+	}
+
+	for _, a := range c.Add {
+		a.Requested = false
+		if held[a] {
+			// re-assigning a held role still makes its scope part of the change
+			for i := range result.Assignments {
+				if result.Assignments[i] == a {
+					result.Assignments[i].Requested = true
+				}
+			}
+			continue
+		}
+		held[a] = true
+		a.Requested = true
+		result.Assignments = append(result.Assignments, a)
+	}
+
+	return result
+}
+
+// Check whether applying `change` to the `current` role configuration of a user
+// breaks any rule of the policy. Check has no side effects; the caller is
+// responsible for loading `current`.
+func (p *Policy) Check(current State, change Change) []Violation {
+	division := p.Division()
+	violations := make([]Violation, 0)
+
+	// unknown roles are reported and left out of the remaining rules
+	known := make([]Assignment, 0, len(change.Add))
+	for _, a := range change.Add {
+		if _, ok := division[a.Role]; !ok {
+			violations = append(violations, Violation{
+				RuleID:  RuleUnknownRole,
+				Message: fmt.Sprintf("Role Function not found: %s", a.Role),
+			})
+			continue
+		}
+		known = append(known, a)
+	}
+	change.Add = known
+
+	result := change.Apply(current)
+
+	// a superadmin may not hold any other role, reported per KLPD
+	if result.SuperAdmin {
+		reported := make(map[string]bool)
+		for _, a := range result.Assignments {
+			if reported[a.KLPD] || !(a.Requested || change.GrantSuperAdmin) {
+				continue
+			}
+			reported[a.KLPD] = true
+			violations = append(violations, Violation{
+				RuleID:  RuleSuperAdmin,
+				Scope:   "KLPD " + a.KLPD,
+				Message: fmt.Sprintf("User's roles in KLPD %s may not have roles and be a superadmin", a.KLPD),
+			})
+		}
+	}
+
+	return append(violations, p.Evaluate(result.Assignments)...)
+}
@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Constraint types
+const (
+	// At most one of Roles may be held in the same scope, e.g. "PP" and "PPK"
+	Exclusive = "exclusive"
+	// Every role held in the same scope must belong to the same division
+	SingleDivision = "single-division"
+	// At most Max assignments of Roles (of any role if empty) may exist in the same scope
+	Cardinality = "cardinality"
+)
+
+// Constraint scopes
+const (
+	ScopeSatker = "satker" // evaluated per satuan kerja
+	ScopeKLPD   = "klpd"   // evaluated per KLPD
+	ScopeGlobal = "global" // evaluated over every KLPD at once
+)
+
+// A separation-of-duties rule evaluated over the roles of a single user
+type Constraint struct {
+	ID          string   `json:"id"`
+	Type        string   `json:"type"`
+	Scope       string   `json:"scope"`
+	Roles       []string `json:"roles,omitempty"`
+	Max         int      `json:"max,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// A single role held by a user in a satuan kerja
+type Assignment struct {
+	KLPD        string
+	SatuanKerja string
+	Role        string
+
+	// Requested marks assignments which are part of the change being validated.
+	// Violations are only reported for scopes containing a requested assignment,
+	// so that unrelated pre-existing state does not block a request.
+	Requested bool
+}
+
+// A broken rule. RuleID tells clients which rule fired.
+type Violation struct {
+	RuleID  string `json:"rule"`
+	Scope   string `json:"scope,omitempty"`
+	Message string `json:"message"`
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+func (c *Constraint) validate(division map[string]string) error {
+	if c.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+
+	switch c.Scope {
+	case ScopeSatker, ScopeKLPD, ScopeGlobal:
+	default:
+		return fmt.Errorf("constraint %s: unknown scope %q", c.ID, c.Scope)
+	}
+
+	switch c.Type {
+	case Exclusive:
+		if len(c.Roles) < 2 {
+			return fmt.Errorf("constraint %s must contain at least two roles", c.ID)
+		}
+	case SingleDivision:
+		if len(c.Roles) != 0 || c.Max != 0 {
+			return fmt.Errorf("constraint %s: %s takes no roles or max", c.ID, SingleDivision)
+		}
+	case Cardinality:
+		if c.Max < 1 {
+			return fmt.Errorf("constraint %s: max must be at least 1", c.ID)
+		}
+	default:
+		return fmt.Errorf("constraint %s: unknown type %q", c.ID, c.Type)
+	}
+
+	for _, role := range c.Roles {
+		if _, ok := division[role]; !ok {
+			return fmt.Errorf("constraint %s: unknown role %s", c.ID, role)
+		}
+	}
+	return nil
+}
+
+// name of the scope an assignment falls in
+func scopeName(scope string, a Assignment) string {
+	switch scope {
+	case ScopeSatker:
+		return fmt.Sprintf("KLPD %s: Satuan Kerja %s", a.KLPD, a.SatuanKerja)
+	case ScopeKLPD:
+		return "KLPD " + a.KLPD
+	default:
+		return "every KLPD"
+	}
+}
+
+// Evaluate every constraint of the policy over the roles of a single user
+func (p *Policy) Evaluate(assignments []Assignment) []Violation {
+	division := p.Division()
+	violations := make([]Violation, 0)
+
+	for _, c := range p.Constraints {
+		// group the assignments by scope, keeping the order they first appear in
+		groups := make(map[string][]Assignment)
+		order := make([]string, 0)
+		for _, a := range assignments {
+			name := scopeName(c.Scope, a)
+			if _, ok := groups[name]; !ok {
+				order = append(order, name)
+			}
+			groups[name] = append(groups[name], a)
+		}
+
+		for _, name := range order {
+			group := groups[name]
+			requested := false
+			for _, a := range group {
+				requested = requested || a.Requested
+			}
+			if !requested {
+				continue
+			}
+
+			message := c.check(group, division)
+			if message != "" {
+				violations = append(violations, Violation{
+					RuleID:  c.ID,
+					Scope:   name,
+					Message: fmt.Sprintf("User's roles in %s %s", name, message),
+				})
+			}
+		}
+	}
+
+	return violations
+}
+
+// returns a description of how `group` breaks the constraint, or "" if it holds
+func (c *Constraint) check(group []Assignment, division map[string]string) string {
+	switch c.Type {
+	case Exclusive:
+		held := make([]string, 0)
+		for _, role := range c.Roles {
+			for _, a := range group {
+				if a.Role == role {
+					held = append(held, role)
+					break
+				}
+			}
+		}
+		if len(held) > 1 {
+			return fmt.Sprintf("may not contain %s at the same time", strings.Join(held, " and "))
+		}
+
+	case SingleDivision:
+		divs := make([]string, 0)
+		for _, a := range group {
+			div, ok := division[a.Role]
+			if !ok {
+				continue
+			}
+			found := false
+			for _, d := range divs {
+				found = found || d == div
+			}
+			if !found {
+				divs = append(divs, div)
+			}
+		}
+		if len(divs) > 1 {
+			return fmt.Sprintf("may not cross-function different division: %s", strings.Join(divs, ", "))
+		}
+
+	case Cardinality:
+		counted := make(map[Assignment]bool)
+		for _, a := range group {
+			if len(c.Roles) == 0 || contains(c.Roles, a.Role) {
+				counted[Assignment{KLPD: a.KLPD, SatuanKerja: a.SatuanKerja, Role: a.Role}] = true
+			}
+		}
+		if len(counted) > c.Max {
+			roles := "roles"
+			if len(c.Roles) != 0 {
+				sorted := append([]string{}, c.Roles...)
+				sort.Strings(sorted)
+				roles = strings.Join(sorted, ", ")
+			}
+			return fmt.Sprintf("may contain at most %d assignments of %s. Got %d", c.Max, roles, len(counted))
+		}
+	}
+
+	return ""
+}
+
+func contains(list []string, item string) bool {
+	for _, x := range list {
+		if x == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Version of the policy file format understood by this package
+const Version = 2
+
+// Policy is the declarative role policy issued by LKPP.
+//
+// Rules for role assignments are expressed as Constraints, e.g.
+//  1. A single user in the same KLPD is not allowed to cross-function, i.e. has roles in different division
+//  2. A single user in the same KLPD cannot be both "PPK" and "PP"
+//
+// A single user may have different function in different "KLPD" unless a constraint says otherwise
+type Policy struct {
+	Version int `json:"version"`
+
+	// Divisions maps each division to the roles it contains
+	Divisions map[string][]string `json:"divisions"`
+
+	// CanAssign maps an assigner role to the roles it is allowed to assign
+	CanAssign map[string][]string `json:"can_assign"`
+
+	// CanRevoke maps an assigner role to the roles it is allowed to revoke.
+	// A role without an entry may revoke the roles it may assign, see RevokeTable
+	CanRevoke map[string][]string `json:"can_revoke,omitempty"`
+
+	// AdminScope maps an assigner role to the organizations it administers: `satker`, the
+	// satuan kerja it is held in (the default), `klpd`, every satuan kerja of its KLPD, or `global`
+	AdminScope map[string]string `json:"admin_scope,omitempty"`
+
+	// Constraints lists the separation-of-duties rules, see Constraint
+	Constraints []Constraint `json:"constraints"`
+
+	// Revision is the sha256 of the policy document, used to tell versions apart
+	Revision string `json:"-"`
+}
+
+// Read and validate the policy file at `path`
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error when reading policy file %s. Err: %s", path, err)
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s. Err: %s", path, err)
+	}
+	return p, nil
+}
+
+// Decode and validate a policy document. Unknown fields are rejected.
+func Parse(data []byte) (*Policy, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var p Policy
+	err := decoder.Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	p.Revision = hex.EncodeToString(sum[:])
+	return &p, nil
+}
+
+// Check that the policy is well formed and only refers to roles declared in a division
+func (p *Policy) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("unsupported policy version %d, expected %d", p.Version, Version)
+	}
+	if len(p.Divisions) == 0 {
+		return fmt.Errorf("policy must declare at least one division")
+	}
+
+	division := make(map[string]string)
+	for _, div := range sortedKeys(p.Divisions) {
+		if len(p.Divisions[div]) == 0 {
+			return fmt.Errorf("division %s has no roles", div)
+		}
+		for _, role := range p.Divisions[div] {
+			if other, ok := division[role]; ok {
+				return fmt.Errorf("role %s is declared in both division %s and %s", role, other, div)
+			}
+			division[role] = div
+		}
+	}
+
+	for _, assigner := range sortedKeys(p.CanAssign) {
+		if _, ok := division[assigner]; !ok {
+			return fmt.Errorf("can_assign: unknown assigner role %s", assigner)
+		}
+		for _, role := range p.CanAssign[assigner] {
+			if _, ok := division[role]; !ok {
+				return fmt.Errorf("can_assign: unknown role %s assignable by %s", role, assigner)
+			}
+		}
+	}
+
+	for _, revoker := range sortedKeys(p.CanRevoke) {
+		if _, ok := division[revoker]; !ok {
+			return fmt.Errorf("can_revoke: unknown revoker role %s", revoker)
+		}
+		for _, role := range p.CanRevoke[revoker] {
+			if _, ok := division[role]; !ok {
+				return fmt.Errorf("can_revoke: unknown role %s revocable by %s", role, revoker)
+			}
+		}
+	}
+
+	for _, role := range sortedKeys(p.AdminScope) {
+		if _, ok := division[role]; !ok {
+			return fmt.Errorf("admin_scope: unknown role %s", role)
+		}
+		scope := p.AdminScope[role]
+		if scope != ScopeSatker && scope != ScopeKLPD && scope != ScopeGlobal {
+			return fmt.Errorf("admin_scope: unknown scope %s of %s", scope, role)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i, constraint := range p.Constraints {
+		err := constraint.validate(division)
+		if err != nil {
+			return fmt.Errorf("constraints[%d]: %s", i, err)
+		}
+		if ids[constraint.ID] {
+			return fmt.Errorf("constraints[%d]: duplicate id %s", i, constraint.ID)
+		}
+		ids[constraint.ID] = true
+	}
+
+	return nil
+}
+
+// RevokeTable maps each role to the roles it may revoke: its `can_revoke` entry if it has one,
+// otherwise its `can_assign` entry. An empty `can_revoke` entry revokes nothing,
+// and a role with only a `can_revoke` entry may revoke without assigning, e.g. a helpdesk
+func (p *Policy) RevokeTable() map[string][]string {
+	table := make(map[string][]string)
+	for assigner, roles := range p.CanAssign {
+		table[assigner] = roles
+	}
+	for revoker, roles := range p.CanRevoke {
+		table[revoker] = roles
+	}
+	return table
+}
+
+// The organizations administered by a holder of `role`, see AdminScope
+func (p *Policy) AdminScopeOf(role string) string {
+	if scope, ok := p.AdminScope[role]; ok {
+		return scope
+	}
+	return ScopeSatker
+}
+
+// Division maps each `role name` to its division (parent)
+func (p *Policy) Division() map[string]string {
+	division := make(map[string]string)
+	for div, roles := range p.Divisions {
+		for _, role := range roles {
+			division[role] = div
+		}
+	}
+	return division
+}
+
+// Roles returns every role declared in the policy, sorted by name
+func (p *Policy) Roles() []string {
+	roles := make([]string, 0)
+	for _, divRoles := range p.Divisions {
+		roles = append(roles, divRoles...)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Watch polls the policy file at `path` every `interval` and calls `onChange`
+// with the newly parsed policy whenever its content differs from `revision`.
+// A version that fails to parse, validate or apply is logged and skipped, so the
+// previously active policy stays in place. Call the returned function to stop watching.
+func Watch(path string, interval time.Duration, revision string, onChange func(*Policy) error) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		var lastModified time.Time
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Printf("Error when watching policy file %s, err %s", path, err)
+				continue
+			}
+			if info.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+
+			p, err := Load(path)
+			if err != nil {
+				log.Printf("Ignoring new policy: %s", err)
+				continue
+			}
+			if p.Revision == revision {
+				continue
+			}
+
+			err = onChange(p)
+			if err != nil {
+				log.Printf("Ignoring new policy %s, err %s", p.Revision, err)
+				continue
+			}
+			revision = p.Revision
+			log.Printf("Policy reloaded from %s, revision %s", path, p.Revision)
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
 
 	"spse-role-poc/api/manager"
 	"spse-role-poc/api/middleware"
@@ -12,6 +13,14 @@ import (
 func New() http.Handler {
 	r := chi.NewRouter()
 
+	// every audit event carries the id of its request
+	r.Use(chimiddleware.RequestID)
+
+	// protected routes require an `Authorization: Bearer` access token with the scopes of the route,
+	// the assigner is the `sub` of the token
+	authenticate := middleware.EnsureValidToken()
+	scope := middleware.RequireScope
+
 	// publicly accessible - to test the api is responding
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -24,11 +33,35 @@ func New() http.Handler {
 	r.Patch("/addroles", manager.AddRolesHandler)
 	r.Patch("/deleteroles", manager.DeleteRolesHandler)
 
+	// validate a role change without applying it, same as `?dry_run=true`
+	r.Post("/validate", manager.ValidateHandler)
+
 	r.Route("/", func(r chi.Router) {
-		r.Use(middleware.ValidateRoleAuthority)
-		r.Post("/create-protected", manager.CreateUserHandler)
-		r.Patch("/addroles-protected", manager.AddRolesHandler)
-		r.Patch("/deleteroles-protected", manager.DeleteRolesHandler)
+		r.Use(authenticate)
+		r.With(scope(middleware.ScopeUsersCreate, middleware.ScopeRolesAssign), middleware.ValidateRoleAuthority).Post("/create-protected", manager.CreateUserHandler)
+		r.With(scope(middleware.ScopeRolesAssign), middleware.ValidateRoleAuthority).Patch("/addroles-protected", manager.AddRolesHandler)
+		r.With(scope(middleware.ScopeRolesRevoke), middleware.ValidateRevokeAuthority).Patch("/deleteroles-protected", manager.DeleteRolesHandler)
+		// nothing is written, so reading is the only scope validating requires
+		r.With(manager.DryRunOnly, scope(middleware.ScopeUsersRead), middleware.ValidateRoleAuthority).Post("/validate-protected", manager.ValidateHandler)
+
+		// read the roles of a user in the format of /addroles
+		r.With(scope(middleware.ScopeUsersRead)).Get("/users/{id}/roles", manager.UserRolesHandler)
+		// replace every role of a user
+		r.With(scope(middleware.ScopeRolesAssign, middleware.ScopeRolesRevoke), middleware.ValidateReplaceAuthority).Put("/users/{id}/roles", manager.ReplaceRolesHandler)
+		// move roles of a user to another satuan kerja (mutasi)
+		r.With(scope(middleware.ScopeRolesAssign, middleware.ScopeRolesRevoke), middleware.ValidateTransferAuthority).Post("/users/{id}/transfer", manager.TransferHandler)
+		// hand the roles of a user over to another (serah terima)
+		r.With(scope(middleware.ScopeRolesAssign, middleware.ScopeRolesRevoke), middleware.ValidateHandoverAuthority).Post("/handover", manager.HandoverHandler)
+		// create users or add roles from CSV or JSON Lines, one /create-protected or /addroles-protected per row
+		r.With(scope(middleware.ScopeUsersCreate, middleware.ScopeRolesAssign), middleware.ValidateImportAuthority).Post("/import", manager.BulkImportHandler)
+		// revoke every access of a user, the assigner must be allowed to revoke each of its roles
+		r.With(scope(middleware.ScopeRolesRevoke), middleware.ValidateOffboardAuthority).Post("/users/{id}/offboard", manager.OffboardHandler)
+
+		// query and export the audit log
+		r.With(scope(middleware.ScopeUsersRead)).Get("/audit", manager.AuditHandler)
+
+		// re-read the role policy file without restarting
+		r.With(scope(middleware.ScopePolicyAdmin)).Post("/admin/policy/reload", manager.ReloadPolicyHandler)
 	})
 
 	return r
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+)
+
+// Run the maintenance command `name`, returning the exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "verify":
+		return verifyCommand(args)
+	case "cleanup-memberships":
+		return cleanupMembershipsCommand(args)
+	case "import":
+		return importCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", name)
+		return 2
+	}
+}
+
+func auditLogPath() string {
+	if os.Getenv("AUDIT_LOG") != "" {
+		return os.Getenv("AUDIT_LOG")
+	}
+	return "audit.jsonl"
+}
+
+// Walk the hash chain of the audit log and its signed checkpoints,
+// reporting the first broken link
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	path := flags.String("log", auditLogPath(), "audit log to verify")
+	key := flags.String("key", os.Getenv("AUDIT_SIGNING_KEY"), "key the checkpoints were signed with")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *key == "" {
+		fmt.Fprintln(os.Stderr, "warning: no signing key, checkpoints are not verified")
+	}
+
+	report, err := audit.Verify(*path, []byte(*key))
+	var link *audit.BrokenLink
+	if errors.As(err, &link) {
+		fmt.Printf("%s is broken at %s\n", *path, link)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Printf("%s is intact: %d events, %d checkpoints, head %s\n", *path, report.Events, report.Checkpoints, report.Head)
+	return 0
+}
+
+// Remove every member without roles from its organization
+func cleanupMembershipsCommand(args []string) int {
+	flags := flag.NewFlagSet("cleanup-memberships", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the memberships without roles")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	setupProvider()
+	sink := setupAudit()
+	defer sink.Close()
+
+	found, err := manager.CleanupMemberships(*dryRun)
+	for _, membership := range found {
+		if *dryRun {
+			fmt.Printf("%s has no roles in %s\n", membership.UserID, membership.Org)
+		} else {
+			fmt.Printf("removed %s from %s\n", membership.UserID, membership.Org)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%d memberships without roles\n", len(found))
+	return 0
+}
+
+// Import users and their roles from a CSV or JSON Lines file, see manager.ImportUsers,
+// writing the result of every row in the same format
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	out := flags.String("out", "", "file to write the results to, stdout if empty")
+	format := flags.String("format", "", "csv or jsonl, by default from the extension of the file")
+	assigner := flags.String("assigner", "", "user id recorded as the assigner in the audit log")
+	dryRun := flags.Bool("dry-run", false, "only validate the rows")
+	flags.IntVar(&manager.BulkConcurrency, "concurrency", manager.BulkConcurrency, "rows handled at the same time")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [flags] FILE")
+		return 2
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = "jsonl"
+		if strings.HasSuffix(strings.ToLower(path), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer file.Close()
+	rows, err := manager.ParseBulk(file, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	setupProvider()
+	setupPolicy()
+	sink := setupAudit()
+	defer sink.Close()
+
+	target := "/import"
+	if *dryRun {
+		target += "?dry_run=true"
+	}
+	r, _ := http.NewRequest(http.MethodPost, target, nil)
+	r.Header.Set("X-Request-Id", fmt.Sprintf("import-%d", time.Now().Unix()))
+	r = r.WithContext(manager.WithAssigner(r.Context(), *assigner))
+	results := manager.ImportUsers(r, rows)
+
+	output := os.Stdout
+	if *out != "" {
+		output, err = os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer output.Close()
+	}
+	err = manager.WriteBulkResults(output, *format, results)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Outcome]++
+	}
+	fmt.Fprintf(os.Stderr, "%d rows: %d applied, %d valid, %d invalid, %d failed\n", len(results),
+		counts[manager.BulkApplied], counts[manager.BulkValid], counts[manager.BulkInvalid], counts[manager.BulkFailed])
+	if counts[manager.BulkInvalid]+counts[manager.BulkFailed] != 0 {
+		return 1
+	}
+	return 0
+}
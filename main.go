@@ -1,30 +1,123 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
 	"spse-role-poc/api/manager"
 	"spse-role-poc/api/router"
 
-	// "github.com/auth0/go-auth0"
-	// "github.com/auth0/go-auth0/management"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	// e.g. `go run . verify` runs a maintenance command instead of serving the API
+	if len(os.Args) > 1 {
+		godotenv.Load()
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
-	manager.ConnectAPI()
-	// manager.GenerateOrganizationAndRoles()
-	manager.RoleSetup()
+	setupProvider()
+
+	setupPolicy()
+	// pick up changes of the policy file without restarting
+	manager.WatchPolicy(5 * time.Second)
+
+	// every role mutation is appended to the audit log
+	sink := setupAudit()
+	defer func() {
+		// signs the final checkpoint
+		err := sink.Close()
+		if err != nil {
+			log.Printf("Error when closing the audit log. Err: %s", err)
+		}
+	}()
+
+	server := &http.Server{Addr: ":" + os.Getenv("API_PORT"), Handler: router.New()}
+
+	// on Ctrl+C or SIGTERM, finish the requests in flight before the audit log is closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Error when shutting down. Err: %s", err)
+		}
+		close(stopped)
+	}()
+
+	log.Printf("Starting up on http://localhost%s", server.Addr)
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		sink.Close()
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Printf("Shut down")
+}
+
+// Connect to the identity provider selected by IDENTITY_PROVIDER
+func setupProvider() {
+	// IDENTITY_PROVIDER=memory runs the API against a seeded in-memory tenant
+	if os.Getenv("IDENTITY_PROVIDER") == "memory" {
+		manager.Provider = identity.NewMemory()
+		manager.GenerateOrganizationAndRoles()
+	} else {
+		provider, err := identity.NewAuth0(os.Getenv("AUTH0_DOMAIN"), os.Getenv("MGMT_ACCESS_TOKEN"))
+		if err != nil {
+			log.Fatal("Error connecting to Auth0 Management API:", err)
+		}
+		manager.Provider = provider
+		// manager.GenerateOrganizationAndRoles()
+	}
+}
+
+// Load the role policy from POLICY_FILE
+func setupPolicy() {
+	if os.Getenv("POLICY_FILE") != "" {
+		manager.PolicyFile = os.Getenv("POLICY_FILE")
+	}
+	_, err := manager.ReloadPolicy()
+	if err != nil {
+		log.Fatal("Error setting up roles: ", err)
+	}
+}
 
-	r := router.New()
-	port := os.Getenv("API_PORT")
-	log.Printf("Starting up on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+// Open the audit log, signing a checkpoint of the audit trail every AUDIT_CHECKPOINT_EVERY events
+func setupAudit() *audit.FileSink {
+	sink, err := audit.NewFileSink(auditLogPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("AUDIT_SIGNING_KEY") != "" {
+		every, err := strconv.Atoi(os.Getenv("AUDIT_CHECKPOINT_EVERY"))
+		if err != nil || every <= 0 {
+			every = 100
+		}
+		err = sink.EnableCheckpoints([]byte(os.Getenv("AUDIT_SIGNING_KEY")), every)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Printf("AUDIT_SIGNING_KEY is not set, the audit trail is not checkpointed")
+	}
+	manager.AuditSink = sink
+	return sink
 }
@@ -2,26 +2,48 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
-	"spse-role-poc/api/manager"
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/go-chi/chi"
 
-	"github.com/joho/godotenv"
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/identity"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/middleware"
+	"spse-role-poc/api/policy"
+	"spse-role-poc/api/router"
 )
 
+// Every test runs against a fresh, seeded in-memory identity provider
 func setup(t *testing.T) {
-	err := godotenv.Load()
+	manager.Provider = identity.NewMemory()
+	manager.GenerateOrganizationAndRoles()
+	manager.AuditSink = audit.Discard{}
+
+	rolePolicy, err := policy.Load("policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.RoleSetup(rolePolicy)
 	if err != nil {
-		t.Fatal("Error loading .env file")
+		t.Fatal(err)
 	}
-	manager.ConnectAPI()
-	manager.RoleSetup()
 }
 
 // Takes `email`, `password,` and `roles` as input, then tries the CreateUserHandler
@@ -74,7 +96,7 @@ func testCreateHelper(t *testing.T, data map[string]interface{}, expectedStatus
 	return ""
 }
 
-// Takes `user_id`, and `roles` as input, then tries the AddRolesHandler or RewriteRolesHandler
+// Takes `user_id`, and `roles` as input, then tries the AddRolesHandler or DeleteRolesHandler
 // to see if it updated the roles of the user as expected
 func testPatchHelper(t *testing.T, command string, data map[string]interface{}, expectedStatus int) {
 	server := httptest.NewServer(http.HandlerFunc(manager.AddRolesHandler))
@@ -113,20 +135,20 @@ func testPatchHelper(t *testing.T, command string, data map[string]interface{},
 
 // Check if the roles of user with <uid> in Auth0 has the same roles as expectedRoles
 func checkRoles(t *testing.T, uid string, expectedRoles []string) error {
-	orgList, err := manager.Auth0API.User.Organizations(uid)
+	orgList, err := manager.Provider.UserOrganizations(uid)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	actualRoles := make([]string, 0)
-	for _, org := range orgList.Organizations {
-		roleList, err := manager.Auth0API.Organization.MemberRoles(*org.ID, uid)
+	for _, org := range orgList {
+		roleList, err := manager.Provider.MemberRoles(org.ID, uid)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		for _, role := range roleList.Roles {
-			actualRoles = append(actualRoles, *org.Name+"-"+*role.Name)
+		for _, role := range roleList {
+			actualRoles = append(actualRoles, org.Name+"-"+role.Name)
 		}
 	}
 	sort.Strings(actualRoles)
@@ -151,7 +173,7 @@ func TestCreateEmptyRole(t *testing.T) {
 		"password": "Test123!",
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 	checkRoles(t, uid, []string{})
 }
 
@@ -176,7 +198,7 @@ func TestCreateOnlyPengelola(t *testing.T) {
 		"klpd":     queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -214,7 +236,7 @@ func TestCreateOnlyPengadaan(t *testing.T) {
 		"klpd":     queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -246,7 +268,7 @@ func TestCreateOnlyAuditor(t *testing.T) {
 		"klpd":     queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -330,7 +352,7 @@ func TestAddRoles(t *testing.T) {
 		"password": "Test123!",
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 
 	queryRoles := []map[string]interface{}{
 		{
@@ -467,7 +489,7 @@ func TestDeleteRoles(t *testing.T) {
 		},
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer manager.Provider.DeleteUser(uid)
 
 	queryRoles := []map[string]interface{}{
 		{
@@ -487,37 +509,1544 @@ func TestDeleteRoles(t *testing.T) {
 	}
 	testPatchHelper(t, "deleteroles", data, http.StatusOK)
 	checkRoles(t, uid, expectedRoles)
+
+	// an unknown user
+	data["id"] = "auth0|unknown"
+	testPatchHelper(t, "deleteroles", data, http.StatusNotFound)
+}
+
+func TestDryRun(t *testing.T) {
+	setup(t)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusCreated)
+	expectedRoles := []string{"a-a1-PP"}
+
+	send := func(handler http.HandlerFunc, url string, body string, expectedStatus int) manager.ErrorMessage {
+		res := httptest.NewRecorder()
+		handler(res, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		if res.Code != expectedStatus {
+			t.Log(res.Body.String())
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, expectedStatus)
+		}
+		var message manager.ErrorMessage
+		json.Unmarshal(res.Body.Bytes(), &message)
+		return message
+	}
+
+	// valid changes are not applied
+	send(manager.AddRolesHandler, "/addroles?dry_run=true", `{"id": "`+uid+`", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a2", "roles": ["KUPBJ"]}]}]}`, http.StatusOK)
+	send(manager.DeleteRolesHandler, "/deleteroles?dry_run=true", `{"id": "`+uid+`", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PP"]}]}]}`, http.StatusOK)
+	send(manager.CreateUserHandler, "/create?dry_run=true", `{"email": "__test101@example.com", "password": "Test123!"}`, http.StatusOK)
+	checkRoles(t, uid, expectedRoles)
+	users, _ := manager.Provider.ListUsers()
+	if len(users) != 1 {
+		t.Fatal("Expected dry run not to create a user. Got ", users)
+	}
+
+	// every violation is reported
+	message := send(manager.ValidateHandler, "/validate", `{"id": "`+uid+`", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a2", "roles": ["PPK", "Helpdesk"]}]}]}`, http.StatusBadRequest)
+	if len(message.Violations) != 2 {
+		t.Fatal("Expected 2 violations. Got ", message)
+	}
+	send(manager.ValidateHandler, "/validate", `{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a2", "roles": ["PPK"]}]}]}`, http.StatusOK)
+	checkRoles(t, uid, expectedRoles)
+}
+
+func TestExplainRoleAuthority(t *testing.T) {
+	setup(t)
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin PPE", "Admin Agency"}}}},
+		},
+	}, http.StatusCreated)
+
+	var data manager.UserInfo
+	json.Unmarshal([]byte(`{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["Admin Agency", "PPK", "Auditor"]}, {"name": "a2", "roles": ["PPK"]}]}]}`), &data)
+	explanation, err := middleware.ExplainRoleAuthority(assigner, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Allowed || len(explanation.Scopes) != 2 {
+		t.Fatal("Unexpected explanation ", explanation)
+	}
+
+	a1 := explanation.Scopes[0]
+	if !a1.Member || strings.Join(a1.AssignerRoles, ",") != "Admin Agency,Admin PPE" {
+		t.Fatal("Unexpected assigner roles ", a1)
+	}
+	decisions := make([]string, 0)
+	for _, decision := range a1.Roles {
+		decisions = append(decisions, decision.Role+":"+strings.Join(decision.GrantedBy, "+")+":"+decision.Rule)
+	}
+	expected := "Admin Agency:Admin PPE:,PPK:Admin Agency:,Auditor::cannot-assign"
+	if strings.Join(decisions, ",") != expected {
+		t.Fatal("Expected ", expected, ". Got ", decisions)
+	}
+
+	// the Admin PPE of a-a1 administers a-a2, but may not assign PPK there
+	a2 := explanation.Scopes[1]
+	if a2.Member || strings.Join(a2.InheritedRoles, ",") != "Admin PPE (a-a1)" || a2.Roles[0].Rule != middleware.RuleCannotAssign {
+		t.Fatal("Unexpected decision ", a2)
+	}
+
+	// Super Admin contributes to every scope
+	manager.Provider.AssignUserRoles(assigner, []string{manager.CurrentRoles().RoleID["Super Admin"]})
+	explanation, err = middleware.ExplainRoleAuthority(assigner, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errList := explanation.Errors()
+	if len(errList) != 1 || explanation.Scopes[1].Roles[0].Rule != middleware.RuleCannotAssign {
+		t.Fatal("Expected only PPK in a2 to be denied. Got ", errList)
+	}
+	for _, decision := range explanation.Scopes[0].Roles {
+		if decision.Role == "Auditor" && (!decision.Allowed || decision.GrantedBy[0] != "Super Admin") {
+			t.Fatal("Expected Auditor to be granted by Super Admin. Got ", decision)
+		}
+	}
+
+	// a satuan kerja which doesn't exist denies its roles instead of failing the check
+	var unknown manager.UserInfo
+	json.Unmarshal([]byte(`{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a9", "roles": ["PPK", "PP"]}]}]}`), &unknown)
+	explanation, err = middleware.ExplainRoleAuthority(assigner, unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errList = explanation.Errors()
+	if explanation.Allowed || len(errList) != 1 || explanation.Scopes[0].Roles[1].Rule != middleware.RuleUnknownOrganization {
+		t.Fatal("Expected the unknown organization to be denied. Got ", errList)
+	}
+}
+
+func TestAuthorityTarget(t *testing.T) {
+	setup(t)
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test117@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin Agency"}}}},
+		},
+	}, http.StatusCreated)
+	pengadaan := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test118@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PPK"}}}},
+		},
+	}, http.StatusCreated)
+	pengelola := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test119@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin PPE"}}}},
+		},
+	}, http.StatusCreated)
+
+	rules := func(data string) string {
+		var user manager.UserInfo
+		json.Unmarshal([]byte(data), &user)
+		errList, err := middleware.CheckRoleAuthority(assigner, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleIDs := make([]string, 0)
+		for _, err := range errList {
+			var violation *policy.Violation
+			errors.As(err, &violation)
+			ruleIDs = append(ruleIDs, violation.RuleID)
+		}
+		return strings.Join(ruleIDs, ",")
+	}
+	kupbj := `"klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["KUPBJ"]}]}]`
+
+	if got := rules(`{"id": "` + pengadaan + `", ` + kupbj + `}`); got != "" {
+		t.Fatal("Expected no violations. Got ", got)
+	}
+	// Super Admin elevation
+	if got := rules(`{"id": "` + pengadaan + `", "superadmin": true}`); got != middleware.RuleCannotAssign {
+		t.Fatal("Expected ", middleware.RuleCannotAssign, ". Got ", got)
+	}
+	// self-assignment
+	if got := rules(`{"id": "` + assigner + `", ` + kupbj + `}`); got != middleware.RuleSelfAssignment {
+		t.Fatal("Expected ", middleware.RuleSelfAssignment, ". Got ", got)
+	}
+	// Admin PPE can't be assigned by Admin Agency
+	if got := rules(`{"id": "` + pengelola + `", ` + kupbj + `}`); got != middleware.RuleTargetOutranks {
+		t.Fatal("Expected ", middleware.RuleTargetOutranks, ". Got ", got)
+	}
+	manager.Provider.AssignUserRoles(pengadaan, []string{manager.CurrentRoles().RoleID["Super Admin"]})
+	if got := rules(`{"id": "` + pengadaan + `", ` + kupbj + `}`); got != middleware.RuleTargetOutranks {
+		t.Fatal("Expected ", middleware.RuleTargetOutranks, ". Got ", got)
+	}
+
+	// roles in another KLPD are not changed
+	other := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test131@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"PPK"}}}},
+		},
+	}, http.StatusCreated)
+	if got := rules(`{"id": "` + other + `", ` + kupbj + `}`); got != "" {
+		t.Fatal("Expected no violations. Got ", got)
+	}
+
+	// an unknown user is reported by the handler
+	if got := rules(`{"id": "auth0|nope", ` + kupbj + `}`); got != "" {
+		t.Fatal("Expected no violations. Got ", got)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("PATCH", "/addroles-protected", strings.NewReader(`{"id": "auth0|nope", `+kupbj+`}`))
+	handler := middleware.ValidateRoleAuthority(http.HandlerFunc(manager.AddRolesHandler))
+	handler.ServeHTTP(res, req.WithContext(manager.WithAssigner(req.Context(), assigner)))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "not found") {
+		t.Fatalf("unexpected response: got %d %s, want %d", res.Code, res.Body.String(), http.StatusBadRequest)
+	}
+}
+
+func TestRevokeAuthority(t *testing.T) {
+	setup(t)
+	rolePolicy, _ := policy.Load("policy.json")
+	rolePolicy.CanRevoke = map[string][]string{"Helpdesk": {"PPK", "PP"}}
+	if err := rolePolicy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RoleSetup(rolePolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	helpdesk := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test120@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Helpdesk"}}}},
+		},
+	}, http.StatusCreated)
+	ppk := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test121@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PPK"}}}},
+		},
+	}, http.StatusCreated)
+	kupbj := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test122@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PPK", "KUPBJ"}}}},
+		},
+	}, http.StatusCreated)
+
+	rules := func(explain func(string, manager.UserInfo) (*middleware.Explanation, error), assigner string, target string) string {
+		data := manager.UserInfo{ID: target, KLPD: []manager.KLPDRoles{{
+			Name:        "a",
+			SatuanKerja: []manager.SatuanKerjaRoles{{Name: "a1", Roles: []string{"PPK"}}},
+		}}}
+		explanation, err := explain(assigner, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ruleIDs := make([]string, 0)
+		for _, err := range explanation.Errors() {
+			var violation *policy.Violation
+			errors.As(err, &violation)
+			ruleIDs = append(ruleIDs, violation.RuleID)
+		}
+		return strings.Join(ruleIDs, ",")
+	}
+
+	// revoke-only
+	if got := rules(middleware.ExplainRevokeAuthority, helpdesk, ppk); got != "" {
+		t.Fatal("Expected the helpdesk to revoke PPK. Got ", got)
+	}
+	if got := rules(middleware.ExplainRoleAuthority, helpdesk, ppk); got != middleware.RuleCannotAssign {
+		t.Fatal("Expected the helpdesk not to assign PPK. Got ", got)
+	}
+	if got := rules(middleware.ExplainRevokeAuthority, helpdesk, kupbj); got != middleware.RuleTargetOutranks {
+		t.Fatal("Expected KUPBJ to outrank the helpdesk. Got ", got)
+	}
+
+	// the middleware decides by the revoke table wherever it is mounted
+	validate := func(authority func(http.Handler) http.Handler) int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/remove-ppk?dry_run=true", strings.NewReader(`{"id": "`+ppk+`", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PPK"]}]}]}`))
+		authority(http.HandlerFunc(manager.DeleteRolesHandler)).ServeHTTP(res, req.WithContext(manager.WithAssigner(req.Context(), helpdesk)))
+		return res.Code
+	}
+	if code := validate(middleware.ValidateRevokeAuthority); code != http.StatusOK {
+		t.Fatalf("unexpected status code: got %d, want %d", code, http.StatusOK)
+	}
+	if code := validate(middleware.ValidateRoleAuthority); code != http.StatusForbidden {
+		t.Fatalf("unexpected status code: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	// a role without a can_revoke entry revokes what it may assign
+	if got := strings.Join(manager.CurrentRoles().CanRevoke["Admin Agency"], ","); got != strings.Join(rolePolicy.CanAssign["Admin Agency"], ",") {
+		t.Fatal("Expected Admin Agency to revoke its assignable roles. Got ", got)
+	}
+}
+
+func TestAdminScope(t *testing.T) {
+	setup(t)
+	rolePolicy, _ := policy.Load("policy.json")
+	rolePolicy.AdminScope = map[string]string{"Admin PPE": policy.ScopeKLPD}
+	if err := rolePolicy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RoleSetup(rolePolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test123@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin PPE"}}}},
+		},
+	}, http.StatusCreated)
+
+	var data manager.UserInfo
+	json.Unmarshal([]byte(`{"klpd": [
+		{"name": "a", "satuan-kerja": [{"name": "a2", "roles": ["Admin Agency"]}, {"name": "a3", "roles": ["Admin Agency", "PPK"]}]},
+		{"name": "b", "satuan-kerja": [{"name": "b1", "roles": ["Admin Agency"]}]}
+	]}`), &data)
+	explanation, err := middleware.ExplainRoleAuthority(admin, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decisions := make([]string, 0)
+	for _, scope := range explanation.Scopes {
+		for _, decision := range scope.Roles {
+			decisions = append(decisions, scope.SatuanKerja+":"+decision.Role+":"+decision.Rule)
+		}
+	}
+	expected := "a2:Admin Agency:,a3:Admin Agency:,a3:PPK:cannot-assign,b1:Admin Agency:no-admin-access"
+	if strings.Join(decisions, ",") != expected {
+		t.Fatal("Expected ", expected, ". Got ", decisions)
+	}
+	if a2 := explanation.Scopes[0]; a2.Member || strings.Join(a2.InheritedRoles, ",") != "Admin PPE (a-a1)" {
+		t.Fatal("Unexpected inherited roles ", a2)
+	}
+
+	rolePolicy.AdminScope["Admin PPE"] = "province"
+	if err := rolePolicy.Validate(); err == nil {
+		t.Fatal("Expected an unknown admin scope to be rejected")
+	}
+}
+
+// Identity provider failing every role assignment in a single organization
+type failingProvider struct {
+	*identity.Memory
+	failOrgID string
+}
+
+func (p *failingProvider) AssignMemberRoles(orgID string, userID string, roleIDs []string) error {
+	if orgID == p.failOrgID {
+		return errors.New("503 Service Unavailable")
+	}
+	return p.Memory.AssignMemberRoles(orgID, userID, roleIDs)
+}
+
+func TestRollback(t *testing.T) {
+	setup(t)
+	memory := manager.Provider.(*identity.Memory)
+	failOrg, _ := memory.ReadOrganizationByName("b-b3")
+	manager.Provider = &failingProvider{Memory: memory, failOrgID: failOrg.ID}
+
+	queryRoles := []map[string]interface{}{
+		{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PP"}}}},
+		{"name": "b", "satuan-kerja": []map[string]interface{}{
+			{"name": "b1", "roles": []string{"KUPBJ"}},
+			{"name": "b3", "roles": []string{"KUPBJ"}},
+		}},
+	}
+
+	// the user created before the failure is deleted again
+	testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"klpd":     queryRoles,
+	}, http.StatusInternalServerError)
+	users, _ := manager.Provider.ListUsers()
+	if len(users) != 0 {
+		t.Fatal("Expected the new user to be rolled back. Got ", users)
+	}
+
+	// only the roles added by the failed request are removed
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ"}}}},
+		},
+	}, http.StatusCreated)
+
+	res := httptest.NewRecorder()
+	body, _ := json.Marshal(map[string]interface{}{"id": uid, "klpd": queryRoles})
+	manager.AddRolesHandler(res, httptest.NewRequest("PATCH", "/addroles", bytes.NewReader(body)))
+	if res.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusInternalServerError)
+	}
+
+	var message manager.ErrorMessage
+	json.Unmarshal(res.Body.Bytes(), &message)
+	expectedRolledBack := []string{
+		"add " + uid + " to b-b3",
+		"assign KUPBJ to " + uid + " in b-b1",
+		"add " + uid + " to b-b1",
+		"assign PP to " + uid + " in a-a1",
+	}
+	if strings.Join(message.RolledBack, ",") != strings.Join(expectedRolledBack, ",") {
+		t.Fatal("Expected ", expectedRolledBack, ". Got ", message)
+	}
+	checkRoles(t, uid, []string{"a-a1-KUPBJ"})
+}
+
+func TestResolveBeforeWrite(t *testing.T) {
+	setup(t)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test101@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ"}}}},
+		},
+	}, http.StatusCreated)
+
+	// the unknown organization comes last, nothing before it may be written
+	testPatchHelper(t, "addroles", map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a2", "roles": []string{"PP"}}}},
+			{"name": "c", "satuan-kerja": []map[string]interface{}{{"name": "c1", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusBadRequest)
+	checkRoles(t, uid, []string{"a-a1-KUPBJ"})
+
+	testPatchHelper(t, "deleteroles", map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ", "Kepala"}}}},
+		},
+	}, http.StatusBadRequest)
+	checkRoles(t, uid, []string{"a-a1-KUPBJ"})
+
+	// no user is created for a request with an unknown organization
+	testCreateHelper(t, map[string]interface{}{
+		"email":    "__test102@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "c", "satuan-kerja": []map[string]interface{}{{"name": "c1", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusBadRequest)
+	users, _ := manager.Provider.ListUsers()
+	if len(users) != 1 {
+		t.Fatal("Expected only one user. Got ", users)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	setup(t)
+	auditLog := t.TempDir() + "/audit.jsonl"
+	sink, err := audit.NewFileSink(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	manager.AuditSink = sink
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test103@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ"}}}},
+		},
+	}, http.StatusCreated)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Anggota Pokmil"}}}},
+		},
+	})
+	req := httptest.NewRequest("PATCH", "/addroles-protected", bytes.NewReader(body))
+	req.Header.Set("X-Request-Id", "req-1")
+	req = req.WithContext(manager.WithAssigner(req.Context(), "auth0|admin"))
+	res := httptest.NewRecorder()
+	manager.AddRolesHandler(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusOK)
+	}
+
+	testPatchHelper(t, "addroles", map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Auditor"}}}},
+		},
+	}, http.StatusBadRequest)
+
+	events, err := audit.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatal("Expected 3 events. Got ", events)
+	}
+
+	created, added, rejected := events[0], events[1], events[2]
+	if created.Action != audit.ActionCreate || created.Target != uid || created.Org != "a-a1" ||
+		len(created.RolesBefore) != 0 || strings.Join(created.RolesAfter, ",") != "KUPBJ" || created.Outcome != audit.OutcomeSuccess {
+		t.Fatal("Unexpected create event ", created)
+	}
+	if added.Assigner != "auth0|admin" || added.RequestID != "req-1" ||
+		strings.Join(added.RolesBefore, ",") != "KUPBJ" || strings.Join(added.RolesAfter, ",") != "Anggota Pokmil,KUPBJ" {
+		t.Fatal("Unexpected addroles event ", added)
+	}
+	if rejected.Outcome != audit.OutcomeRejected || strings.Join(rejected.Requested, ",") != "Auditor" || len(rejected.Errors) == 0 {
+		t.Fatal("Unexpected rejected event ", rejected)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	auditLog := t.TempDir() + "/audit.jsonl"
+	key := []byte("secret")
+	writeEvents := func(targets ...string) {
+		sink, err := audit.NewFileSink(auditLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.EnableCheckpoints(key, 2)
+		for _, target := range targets {
+			err = sink.Write(audit.Event{Action: audit.ActionAddRoles, Target: target, Org: "a-a1", RolesAfter: []string{"PP"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sink.Close()
+	}
+	// the chain continues when the log is reopened
+	writeEvents("auth0|1", "auth0|2", "auth0|3")
+	writeEvents("auth0|4")
+
+	report, err := audit.Verify(auditLog, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 4 || report.Checkpoints != 3 {
+		t.Fatal("Unexpected report ", report)
+	}
+
+	data, _ := os.ReadFile(auditLog)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// altering an event
+	os.WriteFile(auditLog, []byte(strings.Join(lines[:1], "")+strings.Replace(lines[1], "auth0|2", "auth0|5", 1)+strings.Join(lines[2:], "")), 0600)
+	_, err = audit.Verify(auditLog, key)
+	var link *audit.BrokenLink
+	if !errors.As(err, &link) || link.Line != 2 || link.Checkpoint {
+		t.Fatal("Expected a broken link at line 2. Got ", err)
+	}
+
+	// removing the last events
+	os.WriteFile(auditLog, []byte(strings.Join(lines[:2], "")), 0600)
+	_, err = audit.Verify(auditLog, key)
+	if !errors.As(err, &link) || !link.Checkpoint || link.Seq != 3 {
+		t.Fatal("Expected a broken checkpoint for seq 3. Got ", err)
+	}
+
+	// a forged checkpoint
+	_, err = audit.Verify(auditLog, []byte("other"))
+	if !errors.As(err, &link) || link.Reason != "invalid signature" {
+		t.Fatal("Expected an invalid signature. Got ", err)
+	}
+
+	// emptying or removing the checkpoints
+	os.WriteFile(auditLog+".checkpoints", nil, 0600)
+	_, err = audit.Verify(auditLog, key)
+	if !errors.As(err, &link) || !link.Checkpoint {
+		t.Fatal("Expected a missing checkpoint. Got ", err)
+	}
+	os.Remove(auditLog + ".checkpoints")
+	_, err = audit.Verify(auditLog, key)
+	if !errors.As(err, &link) || !link.Checkpoint {
+		t.Fatal("Expected a missing checkpoint. Got ", err)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	setup(t)
+	auditLog := t.TempDir() + "/audit.jsonl"
+	sink, err := audit.NewFileSink(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	manager.AuditSink = sink
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test104@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"KUPBJ"}},
+				{"name": "a2", "roles": []string{"PP"}},
+			}},
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusCreated)
+
+	query := func(params string) (status int, body []byte, header http.Header) {
+		res := httptest.NewRecorder()
+		manager.AuditHandler(res, httptest.NewRequest("GET", "/audit?"+params, nil))
+		return res.Code, res.Body.Bytes(), res.Header()
+	}
+	type page struct {
+		Events     []manager.AuditRecord `json:"events"`
+		NextCursor string                `json:"next-cursor"`
+	}
+
+	// every PP appointment in KLPD a, one page at a time
+	var first, second page
+	_, body, _ := query("role=PP&klpd=a&user=" + uid)
+	json.Unmarshal(body, &first)
+	if len(first.Events) != 1 || first.Events[0].SatuanKerja != "a2" || first.NextCursor != "" {
+		t.Fatal("Unexpected page ", string(body))
+	}
+
+	_, body, _ = query("role=PP&limit=1")
+	json.Unmarshal(body, &first)
+	_, body, _ = query("role=PP&limit=1&cursor=" + first.NextCursor)
+	json.Unmarshal(body, &second)
+	if len(first.Events) != 1 || len(second.Events) != 1 || second.NextCursor != "" ||
+		first.Events[0].KLPD != "a" || second.Events[0].KLPD != "b" {
+		t.Fatal("Unexpected pages ", first, second)
+	}
+
+	// a reopened log is read from the cursor on
+	reopened, err := audit.NewFileSink(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	events, next, err := audit.Query{After: 1, Limit: 1}.Read(reopened)
+	if err != nil || len(events) != 1 || events[0].Seq != 2 || next != 2 {
+		t.Fatal("Unexpected page ", events, next, err)
+	}
+
+	status, body, header := query("format=csv&outcome=success")
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if status != http.StatusOK || header.Get("Content-Type") != "text/csv" || len(lines) != 4 {
+		t.Fatal("Unexpected export ", string(body))
+	}
+
+	status, _, _ = query("from=yesterday")
+	if status != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// events stamped before the sink lock may be appended out of time order
+	unordered, err := audit.NewFileSink(t.TempDir() + "/unordered.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unordered.Close()
+	now := time.Now().UTC()
+	err = unordered.Write(audit.Event{Time: now.Add(time.Second), Target: "late"}, audit.Event{Time: now, Target: "early"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, err = audit.Query{To: now.Add(time.Second)}.Read(unordered)
+	if err != nil || len(events) != 1 || events[0].Target != "early" {
+		t.Fatal("Unexpected page ", events, err)
+	}
+}
+
+func TestReadUserRoles(t *testing.T) {
+	setup(t)
+	klpd := []map[string]interface{}{
+		{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"PP"}}}},
+		{"name": "a", "satuan-kerja": []map[string]interface{}{
+			{"name": "a2", "roles": []string{"PP", "KUPBJ"}},
+			{"name": "a1", "roles": []string{"Anggota Pokmil"}},
+		}},
+	}
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test105@example.com",
+		"password": "Test123!",
+		"klpd":     klpd,
+	}, http.StatusCreated)
+
+	r := chi.NewRouter()
+	r.Get("/users/{id}/roles", manager.UserRolesHandler)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/users/" + url.PathEscape(uid) + "/roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: got %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	expected := `{"id":"` + uid + `","email":"__test105@example.com","klpd":[` +
+		`{"name":"a","satuan-kerja":[{"name":"a1","roles":["Anggota Pokmil"]},{"name":"a2","roles":["KUPBJ","PP"]}]},` +
+		`{"name":"b","satuan-kerja":[{"name":"b1","roles":["PP"]}]}],"superadmin":false}`
+	if strings.TrimSpace(string(body)) != expected {
+		t.Fatal("Expected ", expected, ". Got ", string(body))
+	}
+
+	// the response is accepted by /addroles as it is
+	var user map[string]interface{}
+	json.Unmarshal(body, &user)
+	testPatchHelper(t, "addroles", user, http.StatusOK)
+
+	res, err = http.Get(server.URL + "/users/" + url.PathEscape("auth0|unknown") + "/roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: got %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHyphenatedKLPD(t *testing.T) {
+	setup(t)
+	sink, err := audit.NewFileSink(t.TempDir() + "/audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	manager.AuditSink = sink
+
+	// KLPD `a-b` with Satuan Kerja `c` and KLPD `a` with Satuan Kerja `b-c` share the name `a-b-c`
+	_, err = manager.Provider.CreateOrganization("a-b-c", "KLPD a-b: Satuan Kerja c", map[string]string{"klpd": "a-b", "satuan-kerja": "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test135@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a-b", "satuan-kerja": []map[string]interface{}{{"name": "c", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusCreated)
+
+	user, err := manager.ReadUserRoles(uid)
+	if err != nil || len(user.KLPD) != 1 || user.KLPD[0].Name != "a-b" || user.KLPD[0].SatuanKerja[0].Name != "c" {
+		t.Fatal("Unexpected roles ", user, err)
+	}
+	events, _, err := audit.Query{KLPD: "a-b", SatuanKerja: "c"}.Read(sink)
+	if err != nil || len(events) != 1 || events[0].Org != "a-b-c" {
+		t.Fatal("Unexpected events ", events, err)
+	}
+
+	// the other pair doesn't resolve to the organization of `a-b`
+	testPatchHelper(t, "addroles", map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "b-c", "roles": []string{"KUPBJ"}}}},
+		},
+	}, http.StatusBadRequest)
+	checkRoles(t, uid, []string{"a-b-c-PP"})
+}
+
+func TestReplaceRoles(t *testing.T) {
+	setup(t)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test106@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"KUPBJ"}},
+				{"name": "a2", "roles": []string{"PP"}},
+			}},
+		},
+	}, http.StatusCreated)
+
+	r := chi.NewRouter()
+	r.Put("/users/{id}/roles", manager.ReplaceRolesHandler)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	replace := func(data map[string]interface{}, expectedStatus int) {
+		body, _ := json.Marshal(data)
+		req, _ := http.NewRequest("PUT", server.URL+"/users/"+url.PathEscape(uid)+"/roles", bytes.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			t.Log(string(message))
+			t.Fatalf("unexpected status code: got %d, want %d", res.StatusCode, expectedStatus)
+		}
+	}
+
+	// the roles are validated as a whole, nothing is applied
+	replace(map[string]interface{}{
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"KUPBJ", "Anggota Pokmil"}},
+				{"name": "a2", "roles": []string{"PP"}},
+				{"name": "a3", "roles": []string{"PPK"}},
+			}},
+		},
+	}, http.StatusBadRequest)
+	checkRoles(t, uid, []string{"a-a1-KUPBJ", "a-a2-PP"})
+
+	// the user leaves a2 and joins b1
+	replace(map[string]interface{}{
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ", "Anggota Pokmil"}}}},
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"Auditor"}}}},
+		},
+	}, http.StatusOK)
+	checkRoles(t, uid, []string{"a-a1-KUPBJ", "a-a1-Anggota Pokmil", "b-b1-Auditor"})
+	orgList, _ := manager.Provider.UserOrganizations(uid)
+	if len(orgList) != 2 {
+		t.Fatal("Expected the user to be removed from a-a2. Got ", orgList)
+	}
+
+	replace(map[string]interface{}{"superadmin": true}, http.StatusOK)
+	checkRoles(t, uid, []string{})
+	user, _ := manager.ReadUserRoles(uid)
+	if !user.SuperAdmin {
+		t.Fatal("Expected the user to be a Super Admin")
+	}
+}
+
+func TestEmptyMembership(t *testing.T) {
+	setup(t)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test107@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"KUPBJ", "PP"}},
+				{"name": "a2", "roles": []string{"PP"}},
+			}},
+		},
+	}, http.StatusCreated)
+
+	// revoking the last role in a1 removes the membership, a2 keeps its role
+	testPatchHelper(t, "deleteroles", map[string]interface{}{
+		"id": uid,
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"KUPBJ", "PP"}}}},
+		},
+	}, http.StatusOK)
+	orgList, _ := manager.Provider.UserOrganizations(uid)
+	if len(orgList) != 1 || orgList[0].Name != "a-a2" {
+		t.Fatal("Expected the user to be a member of a-a2 only. Got ", orgList)
+	}
+
+	// memberships left behind earlier are cleaned up
+	org, _ := manager.Provider.ReadOrganizationByName("b-b1")
+	manager.Provider.AddMembers(org.ID, []string{uid})
+	found, err := manager.CleanupMemberships(true)
+	if err != nil || len(found) != 1 || found[0].Org != "b-b1" {
+		t.Fatal("Expected a single membership without roles in b-b1. Got ", found, err)
+	}
+	found, err = manager.CleanupMemberships(false)
+	if err != nil || len(found) != 1 {
+		t.Fatal("Expected a single membership to be removed. Got ", found, err)
+	}
+	found, _ = manager.CleanupMemberships(true)
+	if len(found) != 0 {
+		t.Fatal("Expected no membership without roles. Got ", found)
+	}
+}
+
+func TestOffboard(t *testing.T) {
+	setup(t)
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test108@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"Admin Agency"}},
+				{"name": "a2", "roles": []string{"Admin Agency"}},
+			}},
+		},
+	}, http.StatusCreated)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test109@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"PP"}},
+				{"name": "a2", "roles": []string{"KUPBJ"}},
+			}},
+		},
+	}, http.StatusCreated)
+	org, _ := manager.Provider.ReadOrganizationByName("b-b1")
+	manager.Provider.AddMembers(org.ID, []string{uid})
+
+	_, errList, err := middleware.CheckOffboardAuthority(assigner, uid)
+	if err != nil || len(errList) != 0 {
+		t.Fatal("Expected the assigner to be allowed to offboard. Got ", errList, err)
+	}
+	_, errList, _ = middleware.CheckOffboardAuthority(uid, assigner)
+	if len(errList) == 0 {
+		t.Fatal("Expected the user not to be allowed to offboard the assigner")
+	}
+
+	r := chi.NewRouter()
+	r.Post("/users/{id}/offboard", manager.OffboardHandler)
+	offboard := func(query string) manager.OffboardReport {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest("POST", "/users/"+url.PathEscape(uid)+"/offboard"+query, strings.NewReader(`{"block": true}`)))
+		if res.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusOK)
+		}
+		var report manager.OffboardReport
+		json.Unmarshal(res.Body.Bytes(), &report)
+		return report
+	}
+
+	report := offboard("?dry_run=true")
+	checkRoles(t, uid, []string{"a-a1-PP", "a-a2-KUPBJ"})
+
+	expected := offboard("")
+	if strings.Join(report.Memberships, ",") != "a-a1,a-a2,b-b1" || len(report.Removed) != 1 || len(report.Removed[0].SatuanKerja) != 2 {
+		t.Fatal("Unexpected report ", report)
+	}
+	reportJSON, _ := json.Marshal(report)
+	expectedJSON, _ := json.Marshal(expected)
+	if string(reportJSON) != string(expectedJSON) {
+		t.Fatal("Expected the dry run to report ", string(expectedJSON), ". Got ", string(reportJSON))
+	}
+
+	orgList, _ := manager.Provider.UserOrganizations(uid)
+	user, _ := manager.Provider.ReadUser(uid)
+	if len(orgList) != 0 || !user.Blocked {
+		t.Fatal("Expected the user to be blocked without memberships. Got ", orgList, user)
+	}
+
+	// the block is audited even for a user without roles
+	sink, err := audit.NewFileSink(t.TempDir() + "/audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	manager.AuditSink = sink
+	uid = testCreateHelper(t, map[string]interface{}{"email": "__test124@example.com", "password": "Test123!"}, http.StatusCreated)
+	offboard("")
+	events, _ := sink.Events()
+	if len(events) != 1 || events[0].Target != uid || events[0].Org != "" || !events[0].Blocked || events[0].Outcome != audit.OutcomeSuccess {
+		t.Fatal("Expected a single tenant event recording the block. Got ", events)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	setup(t)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test110@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PP", "KUPBJ"}}}},
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"Auditor"}}}},
+		},
+	}, http.StatusCreated)
+
+	r := chi.NewRouter()
+	r.Post("/users/{id}/transfer", manager.TransferHandler)
+	transfer := func(body string, expectedStatus int) {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest("POST", "/users/"+url.PathEscape(uid)+"/transfer", strings.NewReader(body)))
+		if res.Code != expectedStatus {
+			t.Log(res.Body.String())
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, expectedStatus)
+		}
+	}
+
+	// KLPD b would have both Auditor and PP
+	transfer(`{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "b", "satuan-kerja": "b2"}, "roles": ["PP"]}`, http.StatusBadRequest)
+	transfer(`{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a2"}, "roles": ["PPK"]}`, http.StatusBadRequest)
+	checkRoles(t, uid, []string{"a-a1-PP", "a-a1-KUPBJ", "b-b1-Auditor"})
+
+	// a failed transfer is rolled back
+	memory := manager.Provider.(*identity.Memory)
+	failOrg, _ := memory.ReadOrganizationByName("a-a2")
+	manager.Provider = &failingProvider{Memory: memory, failOrgID: failOrg.ID}
+	transfer(`{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a2"}}`, http.StatusInternalServerError)
+	manager.Provider = memory
+	checkRoles(t, uid, []string{"a-a1-PP", "a-a1-KUPBJ", "b-b1-Auditor"})
+
+	transfer(`{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a2"}, "roles": ["PP"]}`, http.StatusOK)
+	checkRoles(t, uid, []string{"a-a2-PP", "a-a1-KUPBJ", "b-b1-Auditor"})
+
+	// every remaining role, leaving a1 entirely
+	transfer(`{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a3"}}`, http.StatusOK)
+	checkRoles(t, uid, []string{"a-a2-PP", "a-a3-KUPBJ", "b-b1-Auditor"})
+	orgList, _ := manager.Provider.UserOrganizations(uid)
+	if len(orgList) != 3 {
+		t.Fatal("Expected the user to be removed from a-a1. Got ", orgList)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	setup(t)
+	sink, err := audit.NewFileSink(t.TempDir() + "/audit.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	manager.AuditSink = sink
+
+	predecessor := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test111@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{
+				{"name": "a1", "roles": []string{"PPK"}},
+				{"name": "a2", "roles": []string{"KUPBJ"}},
+			}},
+		},
+	}, http.StatusCreated)
+	successor := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test112@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"Auditor"}}}},
+		},
+	}, http.StatusCreated)
+	conflicting := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test113@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a3", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusCreated)
+
+	handover := func(data map[string]interface{}, expectedStatus int) {
+		body, _ := json.Marshal(data)
+		res := httptest.NewRecorder()
+		manager.HandoverHandler(res, httptest.NewRequest("POST", "/handover", bytes.NewReader(body)))
+		if res.Code != expectedStatus {
+			t.Log(res.Body.String())
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, expectedStatus)
+		}
+	}
+
+	// PPK and PP in the same KLPD
+	handover(map[string]interface{}{"from": predecessor, "to": conflicting, "scope": map[string]string{"klpd": "a", "satuan-kerja": "a1"}}, http.StatusBadRequest)
+	checkRoles(t, predecessor, []string{"a-a1-PPK", "a-a2-KUPBJ"})
+
+	handover(map[string]interface{}{"from": predecessor, "to": successor, "scope": map[string]string{"klpd": "a"}}, http.StatusOK)
+	checkRoles(t, predecessor, []string{})
+	checkRoles(t, successor, []string{"a-a1-PPK", "a-a2-KUPBJ", "b-b1-Auditor"})
+	orgList, _ := manager.Provider.UserOrganizations(predecessor)
+	if len(orgList) != 0 {
+		t.Fatal("Expected the predecessor to leave every organization. Got ", orgList)
+	}
+
+	// both sides are audited
+	events, _ := sink.Events()
+	sides := make([]string, 0)
+	for _, event := range events {
+		if event.Action == audit.ActionHandover && event.Outcome == audit.OutcomeSuccess {
+			sides = append(sides, event.Target+":"+event.Org+":"+strings.Join(event.RolesBefore, ",")+">"+strings.Join(event.RolesAfter, ","))
+		}
+	}
+	expected := []string{
+		predecessor + ":a-a1:PPK>", predecessor + ":a-a2:KUPBJ>",
+		successor + ":a-a1:>PPK", successor + ":a-a2:>KUPBJ",
+	}
+	if strings.Join(sides, " ") != strings.Join(expected, " ") {
+		t.Fatal("Expected ", expected, ". Got ", sides)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	setup(t)
+	existing := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test114@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PPK"}}}},
+		},
+	}, http.StatusCreated)
+
+	input := strings.Join([]string{
+		"email,password,id,klpd,satuan-kerja,roles",
+		"__test115@example.com,Test123!,,a,a1,PP;KUPBJ",
+		"__test116@example.com,Test123!,,a,a1,PP;PPK",
+		",," + existing + ",a,a2,Anggota Pokmil",
+		"__test115@example.com,Test123!,,b,b1,Auditor",
+	}, "\n")
+	importCSV := func(query string) []manager.BulkResult {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/import"+query, strings.NewReader(input))
+		req.Header.Set("Content-Type", "text/csv")
+		manager.BulkImportHandler(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusOK)
+		}
+		rows, err := csv.NewReader(res.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make([]manager.BulkResult, 0)
+		for _, row := range rows[1:] {
+			line, _ := strconv.Atoi(row[0])
+			results = append(results, manager.BulkResult{Line: line, ID: row[2], Outcome: row[5]})
+		}
+		return results
+	}
+	outcomes := func(results []manager.BulkResult) string {
+		list := make([]string, 0)
+		for _, result := range results {
+			list = append(list, fmt.Sprintf("%d:%s", result.Line, result.Outcome))
+		}
+		return strings.Join(list, " ")
+	}
+
+	// every row is validated, nothing is applied
+	results := importCSV("?dry_run=true")
+	if outcomes(results) != "2:valid 3:invalid 4:valid" {
+		t.Fatal("Unexpected results of the dry run ", outcomes(results))
+	}
+	userList, _ := manager.Provider.ListUsers()
+	for _, user := range userList {
+		if user.Email == "__test115@example.com" {
+			t.Fatal("Expected the dry run to create no user")
+		}
+	}
+
+	results = importCSV("")
+	if outcomes(results) != "2:applied 3:invalid 4:applied" {
+		t.Fatal("Unexpected results of the import ", outcomes(results))
+	}
+	// the rows of __test115 are merged
+	checkRoles(t, results[0].ID, []string{"a-a1-KUPBJ", "a-a1-PP", "b-b1-Auditor"})
+	checkRoles(t, existing, []string{"a-a1-PPK", "a-a2-Anggota Pokmil"})
+
+	// a malformed record is invalid on its own line
+	input = strings.Join([]string{
+		"email,password,klpd,satuan-kerja,roles",
+		"__test117@example.com,Test123!,a,a1,PP",
+		`a"b,c`,
+		`"__test118@example.com,Test123!,a,a1,PP`,
+	}, "\n")
+	results = importCSV("?dry_run=true")
+	if outcomes(results) != "2:valid 3:invalid 4:invalid" {
+		t.Fatal("Unexpected results of the malformed import ", outcomes(results))
+	}
+}
+
+func TestTokenAssigner(t *testing.T) {
+	setup(t)
+
+	// without a bearer token
+	res := httptest.NewRecorder()
+	router.New().ServeHTTP(res, httptest.NewRequest("PATCH", "/addroles-protected", strings.NewReader(`{"id": "x"}`)))
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+
+	assigner := ""
+	handler := middleware.AssignerFromClaims(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assigner = manager.Assigner(r)
+	}))
+	req := httptest.NewRequest("PATCH", "/addroles-protected", nil)
+	claims := &validator.ValidatedClaims{RegisteredClaims: validator.RegisteredClaims{Subject: "auth0|admin"}}
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), jwtmiddleware.ContextKey{}, claims)))
+	if assigner != "auth0|admin" {
+		t.Fatal("Expected the assigner auth0|admin. Got ", assigner)
+	}
+
+	// the authority check needs an assigner
+	res = httptest.NewRecorder()
+	middleware.ValidateRoleAuthority(http.NotFoundHandler()).ServeHTTP(res, httptest.NewRequest("PATCH", "/addroles-protected", strings.NewReader(`{"id": "x"}`)))
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+
+	// a machine-to-machine client holds no roles
+	res = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/create-protected", strings.NewReader(`{"email": "__test125@example.com", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PP"]}]}]}`))
+	middleware.ValidateRoleAuthority(http.NotFoundHandler()).ServeHTTP(res, req.WithContext(manager.WithAssigner(req.Context(), "client@clients")))
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), middleware.RuleNoAdminAccess) {
+		t.Fatalf("unexpected response: got %d %s, want %d", res.Code, res.Body.String(), http.StatusForbidden)
+	}
+}
+
+func TestRouteAuthority(t *testing.T) {
+	setup(t)
+
+	// every route changing or reading roles requires an access token
+	routes := []string{
+		"POST /create-protected", "PATCH /addroles-protected", "PATCH /deleteroles-protected", "POST /validate-protected",
+		"GET /users/x/roles", "PUT /users/x/roles", "POST /users/x/transfer", "POST /users/x/offboard",
+		"POST /handover", "POST /import", "GET /audit", "POST /admin/policy/reload",
+	}
+	for _, route := range routes {
+		method, target, _ := strings.Cut(route, " ")
+		res := httptest.NewRecorder()
+		router.New().ServeHTTP(res, httptest.NewRequest(method, target, strings.NewReader(`{}`)))
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected status code of %s: got %d, want %d", route, res.Code, http.StatusUnauthorized)
+		}
+	}
+
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test126@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin Agency"}}}},
+		},
+	}, http.StatusCreated)
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test127@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"PP"}}}},
+		},
+	}, http.StatusCreated)
+	successor := testCreateHelper(t, map[string]interface{}{"email": "__test128@example.com", "password": "Test123!"}, http.StatusCreated)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(manager.WithAssigner(r.Context(), assigner)))
+		})
+	})
+	r.With(middleware.ValidateReplaceAuthority).Put("/users/{id}/roles", manager.ReplaceRolesHandler)
+	r.With(middleware.ValidateTransferAuthority).Post("/users/{id}/transfer", manager.TransferHandler)
+	r.With(middleware.ValidateHandoverAuthority).Post("/handover", manager.HandoverHandler)
+	r.With(middleware.ValidateImportAuthority).Post("/import", manager.BulkImportHandler)
+	request := func(method string, target string, body string, expectedStatus int) string {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if res.Code != expectedStatus {
+			t.Log(res.Body.String())
+			t.Fatalf("unexpected status code of %s %s: got %d, want %d", method, target, res.Code, expectedStatus)
+		}
+		return res.Body.String()
+	}
+	users := "/users/" + url.PathEscape(uid)
+
+	// the assigner administers a1 only
+	request("PUT", users+"/roles", `{"klpd": [{"name": "b", "satuan-kerja": [{"name": "b1", "roles": ["PP"]}]}]}`, http.StatusForbidden)
+	request("POST", users+"/transfer", `{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a2"}}`, http.StatusForbidden)
+	checkRoles(t, uid, []string{"a-a1-PP"})
+	request("PUT", users+"/roles", `{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["KUPBJ"]}]}]}`, http.StatusOK)
+	checkRoles(t, uid, []string{"a-a1-KUPBJ"})
+
+	request("POST", "/handover", `{"from": "`+uid+`", "to": "`+successor+`", "scope": {"klpd": "a"}}`, http.StatusOK)
+	checkRoles(t, successor, []string{"a-a1-KUPBJ"})
+	// the assigner cannot change its own roles
+	request("POST", "/handover", `{"from": "`+successor+`", "to": "`+assigner+`", "scope": {"klpd": "a"}}`, http.StatusForbidden)
+
+	// every row of an import is checked
+	body := request("POST", "/import?format=csv", "email,password,klpd,satuan-kerja,roles\n"+
+		"__test129@example.com,Test123!,a,a1,PP\n"+
+		"__test130@example.com,Test123!,b,b1,PP\n", http.StatusOK)
+	if !strings.Contains(body, "2,create,") || !strings.Contains(body, ",applied,") || !strings.Contains(body, "3,create,,__test130@example.com,403,invalid") {
+		t.Fatal("Unexpected results of the import ", body)
+	}
+
+	// an unknown user is reported by the handler, an unknown organization is denied by the authority check
+	request("PUT", "/users/auth0%7Cunknown/roles", `{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PP"]}]}]}`, http.StatusNotFound)
+	request("POST", users+"/transfer", `{"from": {"klpd": "a", "satuan-kerja": "a1"}, "to": {"klpd": "a", "satuan-kerja": "a9"}, "roles": ["PP"]}`, http.StatusForbidden)
+
+	// a role may not be added to a user holding a role the assigner could not have assigned,
+	// in the KLPD the role is added to
+	assigner = testCreateHelper(t, map[string]interface{}{
+		"email":    "__test132@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a2", "roles": []string{"Admin Agency"}}}},
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b1", "roles": []string{"Admin Agency"}}}},
+		},
+	}, http.StatusCreated)
+	uid = testCreateHelper(t, map[string]interface{}{
+		"email":    "__test133@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a1", "roles": []string{"Admin PPE"}}}},
+		},
+	}, http.StatusCreated)
+	request("PUT", "/users/"+url.PathEscape(uid)+"/roles", `{"klpd": [{"name": "a", "satuan-kerja": [
+		{"name": "a1", "roles": ["Admin PPE"]}, {"name": "a2", "roles": ["Verifikator"]}]}]}`, http.StatusForbidden)
+	checkRoles(t, uid, []string{"a-a1-Admin PPE"})
+
+	uid = testCreateHelper(t, map[string]interface{}{
+		"email":    "__test134@example.com",
+		"password": "Test123!",
+		"klpd": []map[string]interface{}{
+			{"name": "a", "satuan-kerja": []map[string]interface{}{{"name": "a2", "roles": []string{"Verifikator"}}}},
+			{"name": "b", "satuan-kerja": []map[string]interface{}{{"name": "b2", "roles": []string{"Admin PPE"}}}},
+		},
+	}, http.StatusCreated)
+	request("POST", "/users/"+url.PathEscape(uid)+"/transfer", `{"from": {"klpd": "a", "satuan-kerja": "a2"}, "to": {"klpd": "b", "satuan-kerja": "b1"}, "roles": ["Verifikator"]}`, http.StatusForbidden)
+	checkRoles(t, uid, []string{"a-a2-Verifikator", "b-b2-Admin PPE"})
+}
+
+func TestRequireScope(t *testing.T) {
+	handler := middleware.RequireScope(middleware.ScopeRolesAssign)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(scope string) int {
+		req := httptest.NewRequest("PATCH", "/addroles-protected", nil)
+		claims := &validator.ValidatedClaims{CustomClaims: &middleware.CustomClaims{Scope: scope}}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), jwtmiddleware.ContextKey{}, claims)))
+		return res.Code
+	}
+
+	if code := request("users:read roles:assign"); code != http.StatusOK {
+		t.Fatalf("unexpected status code: got %d, want %d", code, http.StatusOK)
+	}
+	if code := request("roles:revoke"); code != http.StatusForbidden {
+		t.Fatalf("unexpected status code: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := request("roles:assign:all"); code != http.StatusForbidden {
+		t.Fatalf("unexpected status code: got %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestPolicyUnknownRole(t *testing.T) {
+	invalid := []string{
+		`{"version": 2, "divisions": {"Auditor": ["Auditor"]}, "can_assign": {"Auditor": ["PPK"]}}`,
+		`{"version": 2, "divisions": {"Auditor": ["Auditor"]}, "can_assign": {"Admin PPE": ["Auditor"]}}`,
+		`{"version": 2, "divisions": {"Auditor": ["Auditor", "PP"]}, "constraints": [{"id": "x", "type": "exclusive", "scope": "klpd", "roles": ["PP", "PPK"]}]}`,
+		`{"version": 2, "divisions": {"Auditor": ["Auditor", "PP"]}, "constraints": [{"id": "x", "type": "exclusive", "scope": "satuan-kerja", "roles": ["PP", "Auditor"]}]}`,
+		`{"version": 2, "divisions": {"Auditor": ["Auditor", "PP"]}, "constraints": [{"id": "x", "type": "cardinality", "scope": "global"}]}`,
+		`{"version": 2, "divisions": {"A": ["Auditor"], "B": ["Auditor"]}}`,
+		`{"version": 2, "divisions": {"Auditor": ["Auditor"]}, "unknown": true}`,
+		`{"version": 1, "divisions": {"Auditor": ["Auditor"]}}`,
+	}
+	for _, data := range invalid {
+		_, err := policy.Parse([]byte(data))
+		if err == nil {
+			t.Fatal("Expected policy to be rejected: ", data)
+		}
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	setup(t)
+	before := manager.CurrentRoles()
+
+	manager.PolicyFile = t.TempDir() + "/policy.json"
+	defer func() { manager.PolicyFile = "policy.json" }()
+
+	reload := func(content string, expectedStatus int) {
+		err := os.WriteFile(manager.PolicyFile, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		manager.ReloadPolicyHandler(res, httptest.NewRequest("POST", "/admin/policy/reload", nil))
+		if res.Code != expectedStatus {
+			t.Log(res.Body.String())
+			t.Fatalf("unexpected status code: got %d, want %d", res.Code, expectedStatus)
+		}
+	}
+
+	// Unknown role, the active policy must be kept
+	reload(`{"version": 2, "divisions": {"Auditor": ["Auditor", "Kepala LPSE"]}}`, http.StatusUnprocessableEntity)
+	if manager.CurrentRoles() != before {
+		t.Fatal("Invalid policy must not replace the active one")
+	}
+
+	// a request keeps the snapshot it was pinned to
+	req := httptest.NewRequest("PATCH", "/addroles-protected", nil)
+	req = req.WithContext(manager.WithRoles(req.Context(), before))
+
+	// Auditor may now be combined with Pelaku Pengadaan LPSE roles
+	reload(`{"version": 2, "divisions": {"Super Admin": ["Super Admin"], "Pelaku Pengadaan LPSE": ["PPK", "KUPBJ", "Anggota Pokmil", "PP", "Auditor"]}}`, http.StatusOK)
+	if manager.CurrentRoles() == before {
+		t.Fatal("Expected the new policy to be active")
+	}
+	var user manager.UserInfo
+	err := json.Unmarshal([]byte(`{"klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PP", "PPK", "Auditor"]}]}]}`), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errList := manager.ValidateRolesCombination(user)
+	if errList != nil {
+		t.Fatal("Expected no errors with the reloaded policy. Got ", errList)
+	}
+	if manager.RequestRoles(req) != before {
+		t.Fatal("Expected the request to keep its pinned policy")
+	}
+
+	// reloading requires an access token
+	res := httptest.NewRecorder()
+	router.New().ServeHTTP(res, httptest.NewRequest("POST", "/admin/policy/reload", nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: got %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestConstraintScopes(t *testing.T) {
+	p, err := policy.Parse([]byte(`{
+		"version": 2,
+		"divisions": {"Pelaku Pengadaan LPSE": ["PPK", "KUPBJ", "PP"], "Auditor": ["Auditor"]},
+		"constraints": [
+			{"id": "satker-division", "type": "single-division", "scope": "satker"},
+			{"id": "one-ppk", "type": "cardinality", "scope": "global", "roles": ["PPK"], "max": 1},
+			{"id": "pp-ppk", "type": "exclusive", "scope": "klpd", "roles": ["PP", "PPK"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(assignments []policy.Assignment, expectedRules ...string) {
+		violations := p.Evaluate(assignments)
+		actualRules := make([]string, 0)
+		for _, violation := range violations {
+			actualRules = append(actualRules, violation.RuleID)
+		}
+		if strings.Join(actualRules, ",") != strings.Join(expectedRules, ",") {
+			t.Fatal("Expected ", expectedRules, ". Got ", violations)
+		}
+	}
+
+	// different divisions in different satker of the same KLPD
+	check([]policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PPK", Requested: true},
+		{KLPD: "a", SatuanKerja: "a2", Role: "Auditor", Requested: true},
+	})
+	check([]policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PPK", Requested: true},
+		{KLPD: "a", SatuanKerja: "a1", Role: "Auditor", Requested: true},
+	}, "satker-division")
+
+	// PPK in two KLPD
+	check([]policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PPK"},
+		{KLPD: "b", SatuanKerja: "b1", Role: "PPK", Requested: true},
+	}, "one-ppk")
+
+	// pre-existing PP and PPK in KLPD a are not reported for a change in KLPD b
+	check([]policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PP"},
+		{KLPD: "a", SatuanKerja: "a2", Role: "PPK"},
+		{KLPD: "b", SatuanKerja: "b1", Role: "KUPBJ", Requested: true},
+	})
+	check([]policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PP"},
+		{KLPD: "a", SatuanKerja: "a2", Role: "PPK", Requested: true},
+	}, "pp-ppk")
+}
+
+func TestCheckRoles(t *testing.T) {
+	p, err := policy.Load("policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := policy.State{Assignments: []policy.Assignment{
+		{KLPD: "a", SatuanKerja: "a1", Role: "PP"},
+		{KLPD: "a", SatuanKerja: "a1", Role: "KUPBJ"},
+	}}
+	tests := []struct {
+		change        policy.Change
+		expectedRules []string
+	}{
+		{policy.Change{Add: []policy.Assignment{{KLPD: "a", SatuanKerja: "a2", Role: "Anggota Pokmil"}}}, nil},
+		{policy.Change{Add: []policy.Assignment{{KLPD: "a", SatuanKerja: "a2", Role: "PPK"}}}, []string{"pp-ppk"}},
+		{policy.Change{Add: []policy.Assignment{{KLPD: "a", SatuanKerja: "a2", Role: "Helpdesk"}}}, []string{"single-division"}},
+		{policy.Change{Add: []policy.Assignment{{KLPD: "b", SatuanKerja: "b2", Role: "Helpdesk"}}}, nil},
+		{policy.Change{Add: []policy.Assignment{{KLPD: "b", SatuanKerja: "b2", Role: "Kepala"}}}, []string{"unknown-role"}},
+		// moving PP out of KLPD a makes room for PPK
+		{policy.Change{
+			Remove: []policy.Assignment{{KLPD: "a", SatuanKerja: "a1", Role: "PP"}},
+			Add:    []policy.Assignment{{KLPD: "a", SatuanKerja: "a1", Role: "PPK"}, {KLPD: "b", SatuanKerja: "b1", Role: "PP"}},
+		}, nil},
+		{policy.Change{GrantSuperAdmin: true}, []string{"superadmin-exclusive"}},
+		{policy.Change{
+			Remove:          current.Assignments,
+			GrantSuperAdmin: true,
+		}, nil},
+	}
+
+	for _, test := range tests {
+		violations := p.Check(current, test.change)
+		actualRules := make([]string, 0)
+		for _, violation := range violations {
+			actualRules = append(actualRules, violation.RuleID)
+		}
+		if strings.Join(actualRules, ",") != strings.Join(test.expectedRules, ",") {
+			t.Fatal("Expected ", test.expectedRules, ". Got ", violations, " for ", test.change)
+		}
+	}
+}
+
+func TestViolationRuleID(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(http.HandlerFunc(manager.CreateUserHandler))
+	defer server.Close()
+
+	body := `{"email": "__test100@example.com", "password": "Test123!", "klpd": [{"name": "a", "satuan-kerja": [{"name": "a1", "roles": ["PP"]}, {"name": "a2", "roles": ["PPK", "Auditor", "Kepala"]}]}]}`
+	res, err := http.Post(server.URL+"/create", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var message manager.ErrorMessage
+	err = json.NewDecoder(res.Body).Decode(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := make([]string, 0)
+	for _, violation := range message.Violations {
+		rules = append(rules, violation.RuleID)
+	}
+	sort.Strings(rules)
+	expectedRules := []string{"pp-ppk", "single-division", "unknown-role"}
+	if res.StatusCode != http.StatusBadRequest || strings.Join(rules, ",") != strings.Join(expectedRules, ",") {
+		t.Fatal("Expected ", expectedRules, ". Got ", message)
+	}
 }
 
 // Extra Utility
 func TestDeleteAllTest(t *testing.T) {
 	setup(t)
-	userList, err := manager.Auth0API.User.List()
+	userList, err := manager.Provider.ListUsers()
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
 	uid_to_be_deleted := make([]string, 0)
-	for _, user := range userList.Users {
-		if strings.Contains(*user.Email, "test") {
-			uid_to_be_deleted = append(uid_to_be_deleted, *user.ID)
+	for _, user := range userList {
+		if strings.Contains(user.Email, "test") {
+			uid_to_be_deleted = append(uid_to_be_deleted, user.ID)
 		}
 	}
 
 	for _, uid := range uid_to_be_deleted {
-		manager.Auth0API.User.Delete(uid)
+		manager.Provider.DeleteUser(uid)
 	}
 }
 
 func deleteUser(email string) error {
-	userList, err := manager.Auth0API.User.List()
+	userList, err := manager.Provider.ListUsers()
 	if err != nil {
 		return err
 	}
 
-	for _, user := range userList.Users {
-		if *user.Email == email {
-			manager.Auth0API.User.Delete(*user.ID)
+	for _, user := range userList {
+		if user.Email == email {
+			manager.Provider.DeleteUser(user.ID)
 			return nil
 		}
 	}